@@ -0,0 +1,260 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/skpr/prometheus-cloudwatch/internal/storage"
+)
+
+const (
+	// DefaultMaxBytes is the size the file can grow to before it is rotated.
+	DefaultMaxBytes = 64 << 20
+	// DefaultMaxFiles is the number of rotated files which are kept.
+	DefaultMaxFiles = 5
+
+	// Guards against reading a corrupt line into memory.
+	maxLineSize = 16 << 20
+)
+
+// Params for configuring a dead-letter file.
+type Params struct {
+	// Path of the file which entries are appended to. Rotated files have a number appended eg. deadletter.ndjson.1.
+	Path string
+	// Size the file can grow to before it is rotated.
+	MaxBytes int64
+	// Number of rotated files which are kept. The oldest file is removed when another is rotated.
+	MaxFiles int
+}
+
+// File which datums that could not be pushed to CloudWatch are appended to as newline delimited JSON, so they can be
+// inspected and replayed later.
+type File struct {
+	params Params
+	mutex  sync.Mutex
+	file   *os.File
+	size   int64
+}
+
+// New dead-letter file, which is appended to if it already exists.
+func New(params Params) (*File, error) {
+	if params.Path == "" {
+		return nil, errors.New("path was not provided")
+	}
+
+	if params.MaxBytes <= 0 {
+		params.MaxBytes = DefaultMaxBytes
+	}
+
+	if params.MaxFiles <= 0 {
+		params.MaxFiles = DefaultMaxFiles
+	}
+
+	if err := os.MkdirAll(filepath.Dir(params.Path), 0755); err != nil {
+		return nil, err
+	}
+
+	f := &File{
+		params: params,
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Write entries to the file, rotating it first if they would take it over the maximum size. The entries have been
+// synced to disk once this returns.
+func (f *File) Write(entries ...storage.DeadLetterEntry) error {
+	lines, err := encode(entries)
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return errors.New("dead-letter file is closed")
+	}
+
+	if f.size > 0 && f.size+int64(len(lines)) > f.params.MaxBytes {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.file.Write(lines)
+	f.size += int64(n)
+	fileBytes.Set(float64(f.size))
+
+	if err != nil {
+		return err
+	}
+
+	// Synced before returning, because the batches are acknowledged and removed from the queue once they are written.
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		entriesWritten.WithLabelValues(entry.Code).Inc()
+	}
+
+	return nil
+}
+
+// Close the file.
+func (f *File) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+
+	return err
+}
+
+// Opens the file for appending.
+func (f *File) open() error {
+	file, err := os.OpenFile(f.params.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	fileBytes.Set(float64(f.size))
+
+	return nil
+}
+
+// Renames the file so it is the newest rotated file, shifting the others along and removing the oldest.
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	f.file = nil
+
+	if err := os.Remove(rotated(f.params.Path, f.params.MaxFiles)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for i := f.params.MaxFiles - 1; i > 0; i-- {
+		if err := os.Rename(rotated(f.params.Path, i), rotated(f.params.Path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := os.Rename(f.params.Path, rotated(f.params.Path, 1)); err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+// Encodes entries as newline delimited JSON.
+func encode(entries []storage.DeadLetterEntry) ([]byte, error) {
+	var lines []byte
+
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		lines = append(append(lines, line...), '\n')
+	}
+
+	return lines, nil
+}
+
+// Path of a rotated file.
+func rotated(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// Number of a rotated file.
+func rotation(path, file string) int {
+	n, _ := strconv.Atoi(strings.TrimPrefix(file, path+"."))
+	return n
+}
+
+// Files which have been written to a path, ordered from oldest to newest. The file which is appended to is last.
+func Files(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+
+	for _, match := range matches {
+		if _, err := strconv.Atoi(strings.TrimPrefix(match, path+".")); err == nil {
+			files = append(files, match)
+		}
+	}
+
+	// Rotated files with a higher number are older.
+	sort.Slice(files, func(i, j int) bool {
+		return rotation(path, files[i]) > rotation(path, files[j])
+	})
+
+	return append(files, path), nil
+}
+
+// Read every entry from a dead-letter file.
+func Read(path string) ([]storage.DeadLetterEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var (
+		entries []storage.DeadLetterEntry
+		scanner = bufio.NewScanner(file)
+		line    int
+	)
+
+	scanner.Buffer(nil, maxLineSize)
+
+	for scanner.Scan() {
+		line++
+
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry storage.DeadLetterEntry
+
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
@@ -0,0 +1,100 @@
+package deadletter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/prometheus-cloudwatch/internal/storage"
+)
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "deadletter.ndjson")
+
+	entry := storage.DeadLetterEntry{
+		Namespace: "test",
+		Datum: &cloudwatch.MetricDatum{
+			MetricName: aws.String("metric1"),
+			Dimensions: []*cloudwatch.Dimension{{Name: aws.String("foo"), Value: aws.String("bar")}},
+			Values:     []*float64{aws.Float64(1)},
+		},
+		Code:   cloudwatch.ErrCodeInvalidParameterValueException,
+		Labels: []storage.Labels{{"__name__": "metric1", "foo": "bar"}},
+	}
+
+	file, err := New(Params{Path: path})
+	assert.Nil(t, err)
+	assert.Nil(t, file.Write(entry, entry))
+	assert.Nil(t, file.Close())
+
+	// Entries are appended when the file is opened again.
+	file, err = New(Params{Path: path})
+	assert.Nil(t, err)
+	assert.Nil(t, file.Write(entry))
+	assert.Nil(t, file.Close())
+
+	entries, err := Read(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []storage.DeadLetterEntry{entry, entry, entry}, entries)
+}
+
+func TestFileRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "deadletter.ndjson")
+
+	// Every entry is larger than the file can grow to, so each is written to a file of its own.
+	file, err := New(Params{Path: path, MaxBytes: 1, MaxFiles: 2})
+	assert.Nil(t, err)
+
+	for _, name := range []string{"metric1", "metric2", "metric3", "metric4"} {
+		assert.Nil(t, file.Write(storage.DeadLetterEntry{
+			Namespace: "test",
+			Datum:     &cloudwatch.MetricDatum{MetricName: aws.String(name)},
+		}))
+	}
+
+	assert.Nil(t, file.Close())
+
+	files, err := Files(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{path + ".2", path + ".1", path}, files)
+
+	var names []string
+
+	for _, f := range files {
+		entries, err := Read(f)
+		assert.Nil(t, err)
+
+		for _, entry := range entries {
+			names = append(names, *entry.Datum.MetricName)
+		}
+	}
+
+	// The oldest file has been removed.
+	assert.Equal(t, []string{"metric2", "metric3", "metric4"}, names)
+}
+
+func TestReadCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "deadletter.ndjson")
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("{\"namespace\":\"test\"}\n{\"namespace\n"), 0644))
+
+	_, err = Read(path)
+	assert.NotNil(t, err)
+}
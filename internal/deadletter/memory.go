@@ -0,0 +1,31 @@
+package deadletter
+
+import (
+	"sync"
+
+	"github.com/skpr/prometheus-cloudwatch/internal/storage"
+)
+
+// Memory sink which holds entries until they can be written somewhere else.
+type Memory struct {
+	mutex   sync.Mutex
+	entries []storage.DeadLetterEntry
+}
+
+// Write entries to memory.
+func (m *Memory) Write(entries ...storage.DeadLetterEntry) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.entries = append(m.entries, entries...)
+
+	return nil
+}
+
+// Entries which have been written.
+func (m *Memory) Entries() []storage.DeadLetterEntry {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.entries
+}
@@ -0,0 +1,26 @@
+package deadletter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Namespace used for metrics describing this writer.
+const metricsNamespace = "prometheus_cloudwatch"
+
+var (
+	entriesWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "deadletter_entries_total",
+		Help:      "Number of datums written to the dead-letter file, by error code.",
+	}, []string{"code"})
+
+	fileBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "deadletter_bytes",
+		Help:      "Size of the dead-letter file which is being appended to.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(entriesWritten, fileBytes)
+}
@@ -0,0 +1,116 @@
+package deadletter
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/skpr/prometheus-cloudwatch/internal/storage"
+)
+
+// Sender which pushes batches to CloudWatch.
+type Sender interface {
+	Send(storage.Batch) error
+}
+
+// Replay pushes the entries in the dead-letter files at a path to CloudWatch again. Entries which still could not be
+// pushed, along with any the sender wrote to failed, are synced to a new file which replaces the files that were
+// replayed. Returns the number of entries which were replayed and which are left.
+func Replay(path string, client storage.Interface, sender Sender, failed *Memory) (int, int, error) {
+	files, err := Files(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var entries []storage.DeadLetterEntry
+
+	for _, file := range files {
+		read, err := Read(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		entries = append(entries, read...)
+	}
+
+	for _, batch := range client.Replay(entries) {
+		err := sender.Send(batch)
+		if err == nil {
+			continue
+		}
+
+		// Only the datums which were not pushed are left, in case part of the batch was pushed.
+		if serr, ok := err.(*storage.SendError); ok {
+			batch = serr.Batch
+		}
+
+		failed.Write(batch.DeadLetters(storage.ErrorCode(err))...)
+	}
+
+	left := failed.Entries()
+
+	if len(left) > 0 {
+		// The entries which are left are written before the files are removed, so they are not lost if the replay
+		// is interrupted.
+		if err := replace(path, left); err != nil {
+			return len(entries), len(left), err
+		}
+	}
+
+	for _, file := range files {
+		if len(left) > 0 && file == path {
+			continue
+		}
+
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return len(entries), len(left), err
+		}
+	}
+
+	return len(entries), len(left), nil
+}
+
+// Replaces the file at a path with entries, which are synced to a temporary file that is renamed over it.
+func replace(path string, entries []storage.DeadLetterEntry) error {
+	lines, err := encode(entries)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(lines); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	// Syncs the directory so the rename is durable.
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
@@ -0,0 +1,104 @@
+package deadletter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/prometheus-cloudwatch/internal/storage"
+	mocklog "github.com/skpr/prometheus-cloudwatch/internal/storage/mock/log"
+)
+
+// Sender which pushes every datum except those named bad, which are returned as the datums left to push.
+type mockSender struct {
+	pushed []string
+}
+
+func (s *mockSender) Send(batch storage.Batch) error {
+	left := storage.Batch{Namespace: batch.Namespace}
+
+	for _, datum := range batch.Data {
+		if *datum.MetricName == "bad" {
+			left.Data = append(left.Data, datum)
+			continue
+		}
+
+		s.pushed = append(s.pushed, *datum.MetricName)
+	}
+
+	if len(left.Data) == 0 {
+		return nil
+	}
+
+	return &storage.SendError{
+		Err:   awserr.NewRequestFailure(awserr.New("Throttling", "Rate exceeded", nil), 400, "1"),
+		Batch: left,
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "deadletter.ndjson")
+
+	// Every entry is written to a file of its own.
+	file, err := New(Params{Path: path, MaxBytes: 1})
+	assert.Nil(t, err)
+
+	for _, name := range []string{"metric1", "bad", "metric2", "metric3"} {
+		assert.Nil(t, file.Write(storage.DeadLetterEntry{
+			Namespace: "test",
+			Datum: &cloudwatch.MetricDatum{
+				MetricName: aws.String(name),
+				Values:     []*float64{aws.Float64(1)},
+			},
+		}))
+	}
+
+	assert.Nil(t, file.Close())
+
+	client, err := storage.New(mocklog.New(), "test", 10, storage.Whitelist{
+		Metrics: []storage.Metric{{Name: "metric1"}},
+	})
+	assert.Nil(t, err)
+
+	sender := &mockSender{}
+
+	replayed, left, err := Replay(path, client, sender, &Memory{})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, replayed)
+	assert.Equal(t, 1, left)
+	assert.Equal(t, []string{"metric1", "metric2", "metric3"}, sender.pushed)
+
+	// Only the datum which could not be pushed is left, and the rotated files are removed.
+	files, err := Files(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{path}, files)
+
+	entries, err := Read(path)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "bad", *entries[0].Datum.MetricName)
+	assert.Equal(t, "Throttling", entries[0].Code)
+
+	// The files are removed once every datum has been pushed.
+	*entries[0].Datum.MetricName = "metric4"
+
+	assert.Nil(t, replace(path, entries))
+
+	replayed, left, err = Replay(path, client, sender, &Memory{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, replayed)
+	assert.Equal(t, 0, left)
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,43 @@
+package pipeline
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Namespace used for metrics describing this writer.
+	metricsNamespace = "prometheus_cloudwatch"
+
+	reasonQueueFull = "queue_full"
+	reasonBackoff   = "backoff"
+)
+
+var (
+	queueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "write_queue_length",
+		Help:      "Number of write requests waiting to be processed.",
+	})
+
+	requestsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "write_requests_rejected_total",
+		Help:      "Number of write requests rejected so they are retried later, by reason.",
+	}, []string{"reason"})
+
+	batchesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "batches_failed_total",
+		Help:      "Number of batches which failed to push to CloudWatch, by error code and whether the error was retryable.",
+	}, []string{"code", "retryable"})
+
+	batchesNotRetried = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "batches_not_retried_total",
+		Help:      "Number of batches which could not be queued again to retry because the pipeline had stopped. They are lost when batches are queued in memory.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(queueLength, requestsRejected, batchesFailed, batchesNotRetried)
+}
@@ -0,0 +1,349 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/skpr/prometheus-cloudwatch/internal/queue"
+	"github.com/skpr/prometheus-cloudwatch/internal/storage"
+)
+
+// ErrQueueFull is returned when a write request cannot be queued for processing.
+var ErrQueueFull = errors.New("write queue is full")
+
+// Limits how many times RetryAfter is doubled while CloudWatch keeps throttling, ie. up to 16 times RetryAfter.
+const maxThrottleDoublings = 4
+
+// BackoffError is returned while CloudWatch is throttling or failing requests.
+type BackoffError struct {
+	RetryAfter time.Duration
+	// Throttled is true when the last batch which failed was throttled by CloudWatch.
+	Throttled bool
+}
+
+// Error message for the BackoffError.
+func (e *BackoffError) Error() string {
+	if e.Throttled {
+		return fmt.Sprintf("cloudwatch is throttling requests, retry after %s", e.RetryAfter)
+	}
+
+	return fmt.Sprintf("cloudwatch is unavailable, retry after %s", e.RetryAfter)
+}
+
+// Sender which pushes a batch to CloudWatch.
+type Sender interface {
+	Send(storage.Batch) error
+}
+
+// Params for configuring the pipeline.
+type Params struct {
+	// Number of write requests which can be queued before being rejected.
+	QueueSize int
+	// Number of workers pushing batches to CloudWatch concurrently.
+	Workers int
+	// How frequently aggregated samples are flushed.
+	Frequency time.Duration
+	// How long requests are rejected for after CloudWatch throttles or fails a request. Doubled for each consecutive
+	// batch which CloudWatch throttles.
+	RetryAfter time.Duration
+	// Sink for batches which used up their retry budget. When nil they are queued again after RetryAfter.
+	DeadLetter storage.DeadLetter
+	// Write-ahead log which requests are appended to before they are acknowledged. Requests are replayed into
+	// aggregation when the pipeline starts and truncated once their batches have been queued.
+	WAL *queue.WAL
+}
+
+// Pipeline which decouples receiving remote write requests from pushing them to CloudWatch.
+//
+//	Write -> requests queue -> storage client (aggregation) -> batches -> workers -> CloudWatch
+type Pipeline struct {
+	logger   storage.Logger
+	client   storage.Interface
+	sender   Sender
+	params   Params
+	requests chan prompb.WriteRequest
+	batches  queue.Interface
+	// Batches which were flushed but could not be queued, which are queued again on the next flush.
+	unqueued []storage.Batch
+	// Held while a request is appended to the write-ahead log and queued, so a checkpoint cannot fall between them.
+	mutex sync.Mutex
+	// Unix nanoseconds until which new requests are rejected.
+	backoff int64
+	// Number of consecutive batches which CloudWatch throttled.
+	throttles int64
+}
+
+// New pipeline for pushing metrics to CloudWatch.
+func New(logger storage.Logger, client storage.Interface, sender Sender, batches queue.Interface, params Params) (*Pipeline, error) {
+	if params.QueueSize < 1 {
+		return nil, errors.New("queue size must be at least 1")
+	}
+
+	if params.Workers < 1 {
+		return nil, errors.New("workers must be at least 1")
+	}
+
+	if params.Frequency <= 0 {
+		return nil, errors.New("frequency must be greater than 0")
+	}
+
+	if params.RetryAfter < 0 {
+		return nil, errors.New("retry after must not be negative")
+	}
+
+	pipeline := &Pipeline{
+		logger:   logger,
+		client:   client,
+		sender:   sender,
+		params:   params,
+		requests: make(chan prompb.WriteRequest, params.QueueSize),
+		batches:  batches,
+	}
+
+	return pipeline, nil
+}
+
+// Write queues a request for processing without waiting for it to be pushed to CloudWatch.
+//
+// Returns a BackoffError while CloudWatch is throttling or failing requests and ErrQueueFull when the pipeline
+// cannot keep up, so the sender can retry later instead of the samples being lost. When there is a write-ahead log,
+// the request has been synced to it once this returns.
+func (p *Pipeline) Write(req prompb.WriteRequest) error {
+	if until := time.Unix(0, atomic.LoadInt64(&p.backoff)); time.Now().Before(until) {
+		requestsRejected.WithLabelValues(reasonBackoff).Inc()
+		return &BackoffError{
+			RetryAfter: time.Until(until),
+			Throttled:  atomic.LoadInt64(&p.throttles) > 0,
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.requests) >= cap(p.requests) {
+		requestsRejected.WithLabelValues(reasonQueueFull).Inc()
+		return ErrQueueFull
+	}
+
+	if p.params.WAL != nil {
+		if err := p.params.WAL.Append(req); err != nil {
+			return err
+		}
+	}
+
+	// Cannot block because requests are only queued while holding the mutex.
+	p.requests <- req
+	queueLength.Set(float64(len(p.requests)))
+
+	return nil
+}
+
+// Run the pipeline until stopped. Requests in the write-ahead log are replayed first. Queued requests are processed
+// and flushed before returning.
+func (p *Pipeline) Run(stop <-chan struct{}) error {
+	var wg sync.WaitGroup
+
+	if p.params.WAL != nil {
+		if err := p.params.WAL.Replay(p.add); err != nil {
+			return err
+		}
+
+		defer p.params.WAL.Close()
+	}
+
+	for i := 0; i < p.params.Workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			p.work()
+		}()
+	}
+
+	ticker := time.NewTicker(p.params.Frequency)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			p.drain()
+			p.flush()
+
+			if len(p.unqueued) > 0 {
+				p.logger.Errorf("Stopping with batches which could not be queued: %d", len(p.unqueued))
+			}
+
+			err := p.batches.Close()
+			wg.Wait()
+			return err
+
+		case req := <-p.requests:
+			queueLength.Set(float64(len(p.requests)))
+			p.add(req)
+
+		case <-ticker.C:
+			p.flush()
+		}
+	}
+}
+
+// Adds all series from a request to the storage client for aggregation.
+func (p *Pipeline) add(req prompb.WriteRequest) {
+	for _, ts := range req.Timeseries {
+		if err := p.client.Add(ts); err != nil {
+			p.logger.Errorf("Failed to add series: %s", err)
+		}
+	}
+}
+
+// Processes any requests which are still queued.
+func (p *Pipeline) drain() {
+	for {
+		select {
+		case req := <-p.requests:
+			p.add(req)
+		default:
+			queueLength.Set(0)
+			return
+		}
+	}
+}
+
+// Hands aggregated batches over to the workers, along with any which could not be queued by a previous flush. The
+// write-ahead log is truncated once every request which was appended to it before the flush has been aggregated and
+// its batches have been queued, so it is never truncated past a batch which has not been queued.
+func (p *Pipeline) flush() {
+	var (
+		checkpoint uint64
+		err        error
+	)
+
+	if p.params.WAL != nil {
+		p.mutex.Lock()
+		checkpoint, err = p.params.WAL.Checkpoint()
+		p.mutex.Unlock()
+
+		if err != nil {
+			p.logger.Errorf("Failed to checkpoint write-ahead log: %s", err)
+		}
+	}
+
+	p.drain()
+
+	batches := append(p.unqueued, p.client.Flush()...)
+	p.unqueued = nil
+
+	for _, batch := range batches {
+		if err := p.batches.Push(batch); err != nil {
+			p.logger.Errorf("Failed to queue batch: %s", err)
+			p.unqueued = append(p.unqueued, batch)
+		}
+	}
+
+	if checkpoint == 0 || len(p.unqueued) > 0 {
+		return
+	}
+
+	if err := p.params.WAL.Truncate(checkpoint); err != nil {
+		p.logger.Errorf("Failed to truncate write-ahead log: %s", err)
+	}
+}
+
+// Pushes batches to CloudWatch until the batches queue is closed and empty.
+//
+// Batches which failed with a retryable error are sent to the dead-letter sink, or are queued again once requests
+// stop being rejected. Batches which CloudWatch rejected permanently are sent to the dead-letter sink and acknowledged
+// so they are not retried.
+func (p *Pipeline) work() {
+	for {
+		entry, ok := p.batches.Pop()
+		if !ok {
+			return
+		}
+
+		err := p.sender.Send(entry.Batch)
+		if err == nil {
+			atomic.StoreInt64(&p.throttles, 0)
+			p.batches.Ack(entry)
+			continue
+		}
+
+		code := storage.ErrorCode(err)
+
+		// Only the datums which were not pushed are dead-lettered or retried, in case part of the batch was pushed.
+		if serr, ok := err.(*storage.SendError); ok {
+			entry.Batch = serr.Batch
+		}
+
+		if storage.Retryable(err) {
+			retryAfter := p.params.RetryAfter
+
+			if storage.Throttled(err) {
+				retryAfter = throttleBackoff(p.params.RetryAfter, atomic.AddInt64(&p.throttles, 1))
+			} else {
+				atomic.StoreInt64(&p.throttles, 0)
+			}
+
+			p.logger.Errorf("Failed to push metrics, rejecting requests for %s: %s", retryAfter, err)
+			batchesFailed.WithLabelValues(code, "true").Inc()
+			atomic.StoreInt64(&p.backoff, time.Now().Add(retryAfter).UnixNano())
+
+			if p.deadletter(entry.Batch, code) {
+				p.batches.Ack(entry)
+				continue
+			}
+
+			// Retried after the same delay Prometheus is asked to wait, which grows while CloudWatch keeps throttling.
+			time.AfterFunc(retryAfter, func() {
+				p.retry(entry)
+			})
+
+			continue
+		}
+
+		p.logger.Errorf("Dropping metrics which were rejected by CloudWatch: %s", err)
+		p.deadletter(entry.Batch, code)
+		batchesFailed.WithLabelValues(code, "false").Inc()
+		p.batches.Ack(entry)
+	}
+}
+
+// Queues a batch again so it is retried. The pipeline may have stopped by the time a batch is retried, in which case
+// it is lost when the queue is in memory, or replayed after a restart when the queue is on disk.
+func (p *Pipeline) retry(entry *queue.Entry) {
+	if err := p.batches.Retry(entry); err != nil {
+		p.logger.Errorf("Failed to queue metrics to retry, %d datums were not pushed: %s", len(entry.Batch.Data), err)
+		batchesNotRetried.Inc()
+	}
+}
+
+// How long requests are rejected for after a number of consecutive batches were throttled. RetryAfter is doubled for
+// each batch after the first, so Prometheus backs off further while CloudWatch keeps throttling.
+func throttleBackoff(retryAfter time.Duration, throttles int64) time.Duration {
+	doublings := throttles - 1
+
+	if doublings > maxThrottleDoublings {
+		doublings = maxThrottleDoublings
+	}
+
+	return retryAfter << uint(doublings)
+}
+
+// Sends a batch which could not be pushed to the dead-letter sink, returning false if there is no sink or it failed.
+func (p *Pipeline) deadletter(batch storage.Batch, code string) bool {
+	if p.params.DeadLetter == nil {
+		return false
+	}
+
+	if err := p.params.DeadLetter.Write(batch.DeadLetters(code)...); err != nil {
+		p.logger.Errorf("Failed to write metrics to dead-letter sink: %s", err)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,457 @@
+package pipeline
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/prometheus-cloudwatch/internal/deadletter"
+	"github.com/skpr/prometheus-cloudwatch/internal/queue"
+	"github.com/skpr/prometheus-cloudwatch/internal/storage"
+	mockcloudwatch "github.com/skpr/prometheus-cloudwatch/internal/storage/mock/cloudwatch"
+	mocklog "github.com/skpr/prometheus-cloudwatch/internal/storage/mock/log"
+	storageutils "github.com/skpr/prometheus-cloudwatch/internal/storage/utils"
+)
+
+func TestPipeline(t *testing.T) {
+	var (
+		logger = mocklog.New()
+		now    = storageutils.Timestamp(time.Now())
+	)
+
+	client, err := storage.New(logger, "test", 1, storage.Whitelist{
+		Metrics: []storage.Metric{{Name: "metric1"}, {Name: "metric2"}},
+		Labels:  []string{"foo"},
+	})
+	assert.Nil(t, err)
+
+	svc := mockcloudwatch.New()
+
+	sender, err := storage.NewSender(logger, svc, storage.RetryParams{}, nil)
+	assert.Nil(t, err)
+
+	pipe, err := New(logger, client, sender, queue.NewMemory(1), Params{
+		QueueSize: 2,
+		Workers:   2,
+		Frequency: time.Hour,
+	})
+	assert.Nil(t, err)
+
+	req := prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels: []prompb.Label{
+					{
+						Name:  model.MetricNameLabel,
+						Value: "metric1",
+					},
+					{
+						Name:  "foo",
+						Value: "bar",
+					},
+				},
+				Samples: []prompb.Sample{
+					{
+						Value:     1,
+						Timestamp: now,
+					},
+				},
+			},
+			{
+				Labels: []prompb.Label{
+					{
+						Name:  model.MetricNameLabel,
+						Value: "metric2",
+					},
+					{
+						Name:  "foo",
+						Value: "bar",
+					},
+				},
+				Samples: []prompb.Sample{
+					{
+						Value:     2,
+						Timestamp: now,
+					},
+				},
+			},
+		},
+	}
+
+	// Requests are queued until the pipeline is running.
+	assert.Nil(t, pipe.Write(req))
+	assert.Nil(t, pipe.Write(req))
+	assert.Equal(t, ErrQueueFull, pipe.Write(req))
+
+	stop := make(chan struct{})
+	close(stop)
+
+	// Queued requests are aggregated and flushed when stopped.
+	assert.Nil(t, pipe.Run(stop))
+	assert.Len(t, svc.Inputs, 2)
+}
+
+func TestPipelineBackoff(t *testing.T) {
+	var (
+		logger = mocklog.New()
+		now    = storageutils.Timestamp(time.Now())
+	)
+
+	client, err := storage.New(logger, "test", 1, storage.Whitelist{
+		Metrics: []storage.Metric{{Name: "metric1"}},
+		Labels:  []string{"foo"},
+	})
+	assert.Nil(t, err)
+
+	svc := mockcloudwatch.New()
+	svc.Err = awserr.NewRequestFailure(awserr.New("Throttling", "Rate exceeded", nil), 400, "1")
+
+	sender, err := storage.NewSender(logger, svc, storage.RetryParams{}, nil)
+	assert.Nil(t, err)
+
+	deadletters := &deadletter.Memory{}
+
+	pipe, err := New(logger, client, sender, queue.NewMemory(1), Params{
+		QueueSize:  1,
+		Workers:    1,
+		Frequency:  time.Hour,
+		RetryAfter: time.Hour,
+		DeadLetter: deadletters,
+	})
+	assert.Nil(t, err)
+
+	req := prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels: []prompb.Label{
+					{
+						Name:  model.MetricNameLabel,
+						Value: "metric1",
+					},
+					{
+						Name:  "foo",
+						Value: "bar",
+					},
+				},
+				Samples: []prompb.Sample{
+					{
+						Value:     1,
+						Timestamp: now,
+					},
+				},
+			},
+		},
+	}
+
+	assert.Nil(t, pipe.Write(req))
+
+	stop := make(chan struct{})
+	close(stop)
+
+	assert.Nil(t, pipe.Run(stop))
+
+	// Requests are rejected while CloudWatch is throttling.
+	err = pipe.Write(req)
+	assert.IsType(t, &BackoffError{}, err)
+	assert.True(t, err.(*BackoffError).RetryAfter > 0)
+	assert.True(t, err.(*BackoffError).Throttled)
+
+	// The batch which used up its retry budget was sent to the dead-letter sink.
+	assert.Len(t, deadletters.Entries(), 1)
+	assert.Equal(t, "Throttling", deadletters.Entries()[0].Code)
+	assert.Equal(t, []storage.Labels{{model.MetricNameLabel: "metric1", "foo": "bar"}}, deadletters.Entries()[0].Labels)
+}
+
+func TestPipelinePartialBatch(t *testing.T) {
+	var (
+		logger = mocklog.New()
+		now    = storageutils.Timestamp(time.Now())
+	)
+
+	client, err := storage.New(logger, "test", 4, storage.Whitelist{
+		Metrics: []storage.Metric{{Name: "bad"}, {Name: "metric1"}, {Name: "metric2"}, {Name: "metric3"}},
+		Labels:  []string{"foo"},
+	})
+	assert.Nil(t, err)
+
+	var (
+		svc         = mockcloudwatch.New()
+		deadletters = &deadletter.Memory{}
+		throttled   = awserr.NewRequestFailure(awserr.New("Throttling", "Rate exceeded", nil), 400, "1")
+		invalid     = awserr.NewRequestFailure(awserr.New(cloudwatch.ErrCodeInvalidParameterValueException, "Invalid", nil), 400, "2")
+	)
+
+	// Requests with the bad datum are rejected so the batch is bisected, and requests after the first which is
+	// pushed are throttled, so part of the batch is pushed before a retryable failure.
+	svc.Validate = func(input *cloudwatch.PutMetricDataInput) error {
+		if len(svc.Inputs) > 0 {
+			return throttled
+		}
+
+		for _, datum := range input.MetricData {
+			if *datum.MetricName == "bad" {
+				return invalid
+			}
+		}
+
+		return nil
+	}
+
+	sender, err := storage.NewSender(logger, svc, storage.RetryParams{}, deadletters)
+	assert.Nil(t, err)
+
+	pipe, err := New(logger, client, sender, queue.NewMemory(1), Params{
+		QueueSize:  1,
+		Workers:    1,
+		Frequency:  time.Hour,
+		RetryAfter: time.Hour,
+		DeadLetter: deadletters,
+	})
+	assert.Nil(t, err)
+
+	var req prompb.WriteRequest
+
+	for _, name := range []string{"bad", "metric1", "metric2", "metric3"} {
+		req.Timeseries = append(req.Timeseries, prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: model.MetricNameLabel, Value: name}, {Name: "foo", Value: "bar"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: now}},
+		})
+	}
+
+	assert.Nil(t, pipe.Write(req))
+
+	stop := make(chan struct{})
+	close(stop)
+
+	assert.Nil(t, pipe.Run(stop))
+
+	// Every datum was either pushed or dead-lettered, and none of them twice.
+	var names []string
+
+	for _, input := range svc.Inputs {
+		for _, datum := range input.MetricData {
+			names = append(names, *datum.MetricName)
+		}
+	}
+
+	assert.NotEmpty(t, names)
+
+	for _, entry := range deadletters.Entries() {
+		names = append(names, *entry.Datum.MetricName)
+	}
+
+	assert.ElementsMatch(t, []string{"bad", "metric1", "metric2", "metric3"}, names)
+}
+
+func TestPipelineAggregatesAcrossBatches(t *testing.T) {
+	var (
+		logger = mocklog.New()
+		now    = storageutils.Timestamp(time.Now())
+	)
+
+	// Every datum is pushed in a batch of its own, but series are still aggregated until the flush.
+	client, err := storage.New(logger, "test", 1, storage.Whitelist{
+		Metrics: []storage.Metric{
+			{
+				Name:      "metric1",
+				Collision: storage.CollisionSum,
+				Rollups:   []storage.Rollup{{Aggregation: storage.RollupSum}},
+			},
+		},
+		Labels: []string{"namespace"},
+	})
+	assert.Nil(t, err)
+
+	svc := mockcloudwatch.New()
+
+	sender, err := storage.NewSender(logger, svc, storage.RetryParams{}, nil)
+	assert.Nil(t, err)
+
+	pipe, err := New(logger, client, sender, queue.NewMemory(1), Params{
+		QueueSize: 1,
+		Workers:   1,
+		Frequency: time.Hour,
+	})
+	assert.Nil(t, err)
+
+	var (
+		stop = make(chan struct{})
+		done = make(chan error)
+	)
+
+	go func() {
+		done <- pipe.Run(stop)
+	}()
+
+	// The series of both pods collapse into the same datum and the same rollup.
+	for _, pod := range []struct {
+		name  string
+		value float64
+	}{
+		{"a", 10},
+		{"b", 20},
+	} {
+		assert.Nil(t, pipe.Write(prompb.WriteRequest{
+			Timeseries: []prompb.TimeSeries{
+				{
+					Labels: []prompb.Label{
+						{Name: model.MetricNameLabel, Value: "metric1"},
+						{Name: "namespace", Value: "default"},
+						{Name: "pod", Value: pod.name},
+					},
+					Samples: []prompb.Sample{{Value: pod.value, Timestamp: now}},
+				},
+			},
+		}))
+
+		// Waits for the request to be aggregated by the running pipeline before the next is written.
+		deadline := time.Now().Add(5 * time.Second)
+
+		for len(pipe.requests) > 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	close(stop)
+	assert.Nil(t, <-done)
+
+	var values []float64
+
+	for _, input := range svc.Inputs {
+		for _, datum := range input.MetricData {
+			assert.Len(t, datum.Values, 1)
+			values = append(values, *datum.Values[0])
+		}
+	}
+
+	// One datum for the collision and one for the rollup, instead of a datum for each pod.
+	assert.Equal(t, []float64{30, 30}, values)
+}
+
+func TestPipelineRetryStopped(t *testing.T) {
+	logger := mocklog.New()
+
+	pipe, err := New(logger, nil, nil, queue.NewMemory(1), Params{
+		QueueSize: 1,
+		Workers:   1,
+		Frequency: time.Hour,
+	})
+	assert.Nil(t, err)
+
+	assert.Nil(t, pipe.batches.Close())
+
+	// A retry which fires once the pipeline has stopped is logged instead of being queued where nothing pops it.
+	pipe.retry(&queue.Entry{Batch: storage.Batch{Namespace: "test", Data: []*cloudwatch.MetricDatum{{}}}})
+	assert.Equal(t, []string{"Failed to queue metrics to retry, 1 datums were not pushed: queue is closed"}, logger.Messages)
+}
+
+// Queue which fails to push a number of batches before pushing the rest.
+type failingQueue struct {
+	queue.Interface
+	failures int
+}
+
+func (q *failingQueue) Push(batch storage.Batch) error {
+	if q.failures > 0 {
+		q.failures--
+		return errors.New("disk is full")
+	}
+
+	return q.Interface.Push(batch)
+}
+
+func TestPipelineQueueFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		logger = mocklog.New()
+		now    = storageutils.Timestamp(time.Now())
+	)
+
+	client, err := storage.New(logger, "test", 10, storage.Whitelist{
+		Metrics: []storage.Metric{{Name: "metric1"}},
+		Labels:  []string{"foo"},
+	})
+	assert.Nil(t, err)
+
+	wal, err := queue.NewWAL(dir)
+	assert.Nil(t, err)
+
+	batches := &failingQueue{Interface: queue.NewMemory(10), failures: 1}
+
+	pipe, err := New(logger, client, nil, batches, Params{
+		QueueSize: 1,
+		Workers:   1,
+		Frequency: time.Hour,
+		WAL:       wal,
+	})
+	assert.Nil(t, err)
+
+	assert.Nil(t, pipe.Write(prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels:  []prompb.Label{{Name: model.MetricNameLabel, Value: "metric1"}, {Name: "foo", Value: "bar"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: now}},
+			},
+		},
+	}))
+
+	// The batch could not be queued, so it is kept for the next flush.
+	pipe.flush()
+	assert.Len(t, pipe.unqueued, 1)
+
+	// The next flush queues the batch before the write-ahead log is truncated.
+	pipe.flush()
+	assert.Len(t, pipe.unqueued, 0)
+	assert.Nil(t, batches.Close())
+
+	entry, ok := batches.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, "metric1", *entry.Batch.Data[0].MetricName)
+
+	assert.Nil(t, wal.Close())
+
+	wal, err = queue.NewWAL(dir)
+	assert.Nil(t, err)
+
+	var replayed int
+
+	assert.Nil(t, wal.Replay(func(prompb.WriteRequest) {
+		replayed++
+	}))
+
+	assert.Equal(t, 0, replayed)
+	assert.Nil(t, wal.Close())
+}
+
+func TestThrottleBackoff(t *testing.T) {
+	tests := []struct {
+		throttles int64
+		want      time.Duration
+	}{
+		{throttles: 1, want: 10 * time.Second},
+		{throttles: 2, want: 20 * time.Second},
+		{throttles: 3, want: 40 * time.Second},
+		{throttles: 5, want: 160 * time.Second},
+		{throttles: 100, want: 160 * time.Second},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, throttleBackoff(10*time.Second, test.throttles), test.throttles)
+	}
+}
+
+func TestNewInvalidParams(t *testing.T) {
+	_, err := New(mocklog.New(), nil, nil, nil, Params{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,468 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skpr/prometheus-cloudwatch/internal/storage"
+)
+
+const (
+	// DefaultSegmentSize is the size a segment can grow to before a new one is started.
+	DefaultSegmentSize = 8 << 20
+
+	// Extension for segment files.
+	segmentExtension = ".seg"
+	// Each record starts with its length and a CRC32 checksum of the payload.
+	headerSize = 8
+	// Guards against allocating a corrupt length.
+	maxRecordSize = 64 << 20
+
+	reasonSize    = "size"
+	reasonAge     = "age"
+	reasonCorrupt = "corrupt"
+)
+
+// errCorrupt is returned when a record fails its checksum or has been partially written.
+var errCorrupt = errors.New("record is corrupt")
+
+// DiskParams for configuring a disk backed queue.
+type DiskParams struct {
+	// Directory where segments are stored.
+	Path string
+	// Maximum number of bytes stored before the oldest segments are dropped. Zero is unlimited.
+	MaxBytes int64
+	// Maximum age of a segment before it is dropped. Zero is unlimited.
+	MaxAge time.Duration
+	// Size a segment can grow to before a new one is started.
+	SegmentSize int64
+}
+
+// Disk queue which appends batches to segment files so they survive a restart.
+//
+// Segments are deleted once every record has been acknowledged. Segments which remain after a restart are
+// replayed, so batches are delivered at least once.
+type Disk struct {
+	params   DiskParams
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	closed   bool
+	sequence uint64
+	// Ordered from oldest to newest. The last segment is the head which is appended to.
+	segments []*segment
+	head     *os.File
+}
+
+// Segment file and how far it has been consumed.
+type segment struct {
+	sequence uint64
+	path     string
+	size     int64
+	records  int
+	read     int
+	acked    int
+	offset   int64
+	modified time.Time
+}
+
+// NewDisk queue which stores segments in the given directory, replaying any which already exist.
+func NewDisk(params DiskParams) (*Disk, error) {
+	if params.Path == "" {
+		return nil, errors.New("path was not provided")
+	}
+
+	if params.SegmentSize <= 0 {
+		params.SegmentSize = DefaultSegmentSize
+	}
+
+	if err := os.MkdirAll(params.Path, 0755); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(params.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	disk := &Disk{
+		params: params,
+	}
+
+	disk.cond = sync.NewCond(&disk.mutex)
+
+	// ReadDir returns files sorted by name, which is also the order segments were written.
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), segmentExtension) {
+			continue
+		}
+
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), segmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		s := &segment{
+			sequence: sequence,
+			path:     filepath.Join(params.Path, file.Name()),
+			modified: file.ModTime(),
+		}
+
+		if err := s.scan(); err != nil {
+			return nil, err
+		}
+
+		if sequence > disk.sequence {
+			disk.sequence = sequence
+		}
+
+		if s.records == 0 {
+			if err := os.Remove(s.path); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		disk.segments = append(disk.segments, s)
+	}
+
+	if err := disk.rotate(); err != nil {
+		return nil, err
+	}
+
+	disk.updateMetrics()
+
+	return disk, nil
+}
+
+// Push a batch onto the queue. The batch has been synced to disk once this returns.
+func (d *Disk) Push(batch storage.Batch) error {
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[headerSize:], payload)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed {
+		return ErrClosed
+	}
+
+	head := d.segments[len(d.segments)-1]
+
+	if head.size > 0 && head.size+int64(len(record)) > d.params.SegmentSize {
+		if err := d.rotate(); err != nil {
+			return err
+		}
+
+		head = d.segments[len(d.segments)-1]
+	}
+
+	if _, err := d.head.Write(record); err != nil {
+		// Discard the partial record and start again with a fresh segment.
+		os.Truncate(head.path, head.size)
+		d.rotate()
+		return err
+	}
+
+	if err := d.head.Sync(); err != nil {
+		return err
+	}
+
+	head.size += int64(len(record))
+	head.records++
+	head.modified = time.Now()
+
+	d.enforce(time.Now())
+	d.updateMetrics()
+	d.cond.Signal()
+
+	return nil
+}
+
+// Pop the next batch from the queue, blocking until one is available.
+func (d *Disk) Pop() (*Entry, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for {
+		d.enforce(time.Now())
+
+		for _, s := range d.segments {
+			if s.read >= s.records {
+				continue
+			}
+
+			batch, n, err := s.readAt(s.offset)
+			if err != nil {
+				// The rest of the segment cannot be trusted.
+				droppedBatches.WithLabelValues(reasonCorrupt).Add(float64(s.records - s.read))
+				s.acked += s.records - s.read
+				s.read = s.records
+				d.cleanup()
+				d.updateMetrics()
+				continue
+			}
+
+			s.offset += n
+			s.read++
+
+			return &Entry{Batch: batch, segment: s.sequence}, true
+		}
+
+		if d.closed {
+			return nil, false
+		}
+
+		d.cond.Wait()
+	}
+}
+
+// Ack a batch which has been pushed so its segment can eventually be deleted.
+func (d *Disk) Ack(entry *Entry) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, s := range d.segments {
+		if s.sequence == entry.segment {
+			s.acked++
+			break
+		}
+	}
+
+	d.cleanup()
+	d.updateMetrics()
+}
+
+// Retry a batch by appending it to the queue again and acknowledging the entry it came from. The entry is left to be
+// replayed after a restart if the batch cannot be appended.
+func (d *Disk) Retry(entry *Entry) error {
+	if err := d.Push(entry.Batch); err != nil {
+		return err
+	}
+
+	d.Ack(entry)
+
+	return nil
+}
+
+// Close the queue. Batches already on disk can still be popped.
+func (d *Disk) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed {
+		return nil
+	}
+
+	d.closed = true
+	d.cond.Broadcast()
+
+	return d.head.Close()
+}
+
+// Starts a new head segment.
+func (d *Disk) rotate() error {
+	if d.head != nil {
+		d.head.Close()
+	}
+
+	d.sequence++
+
+	s := &segment{
+		sequence: d.sequence,
+		path:     filepath.Join(d.params.Path, fmt.Sprintf("%020d%s", d.sequence, segmentExtension)),
+		modified: time.Now(),
+	}
+
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	d.head = file
+	d.segments = append(d.segments, s)
+
+	return nil
+}
+
+// Deletes segments which have been fully acknowledged. The head is truncated instead so it can be reused.
+func (d *Disk) cleanup() {
+	var segments []*segment
+
+	for i, s := range d.segments {
+		done := s.read >= s.records && s.acked >= s.records
+
+		if i == len(d.segments)-1 {
+			if done && s.records > 0 && os.Truncate(s.path, 0) == nil {
+				s.size, s.records, s.read, s.acked, s.offset = 0, 0, 0, 0, 0
+			}
+
+			segments = append(segments, s)
+			continue
+		}
+
+		if done && os.Remove(s.path) == nil {
+			continue
+		}
+
+		segments = append(segments, s)
+	}
+
+	d.segments = segments
+}
+
+// Drops segments which exceed the configured age and size limits.
+func (d *Disk) enforce(now time.Time) {
+	if d.params.MaxAge > 0 {
+		for len(d.segments) > 0 && d.segments[0].records > 0 && now.Sub(d.segments[0].modified) > d.params.MaxAge {
+			if len(d.segments) == 1 && d.closed {
+				break
+			}
+
+			if len(d.segments) == 1 && d.rotate() != nil {
+				break
+			}
+
+			d.drop(reasonAge)
+		}
+	}
+
+	if d.params.MaxBytes > 0 {
+		for len(d.segments) > 1 && d.size() > d.params.MaxBytes {
+			d.drop(reasonSize)
+		}
+	}
+}
+
+// Drops the oldest segment, including records which have not been read yet.
+func (d *Disk) drop(reason string) {
+	s := d.segments[0]
+
+	droppedBatches.WithLabelValues(reason).Add(float64(s.records - s.read))
+	os.Remove(s.path)
+
+	d.segments = d.segments[1:]
+}
+
+// Total number of bytes stored across all segments.
+func (d *Disk) size() int64 {
+	var size int64
+
+	for _, s := range d.segments {
+		size += s.size
+	}
+
+	return size
+}
+
+// Publishes the depth and size of the queue.
+func (d *Disk) updateMetrics() {
+	var depth int
+
+	for _, s := range d.segments {
+		depth += s.records - s.acked
+	}
+
+	queueDepth.Set(float64(depth))
+	queueBytes.Set(float64(d.size()))
+}
+
+// Counts the valid records in a segment, truncating a partially written record at the end.
+func (s *segment) scan() error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+
+	for {
+		payload, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			droppedBatches.WithLabelValues(reasonCorrupt).Inc()
+			file.Close()
+			return os.Truncate(s.path, s.size)
+		}
+
+		s.size += int64(headerSize + len(payload))
+		s.records++
+	}
+
+	return file.Close()
+}
+
+// Reads the batch stored at an offset and returns the number of bytes it occupied.
+func (s *segment) readAt(offset int64) (storage.Batch, int64, error) {
+	var batch storage.Batch
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return batch, 0, err
+	}
+	defer file.Close()
+
+	payload, err := readRecord(io.NewSectionReader(file, offset, s.size-offset))
+	if err != nil {
+		return batch, 0, err
+	}
+
+	err = json.Unmarshal(payload, &batch)
+	if err != nil {
+		return batch, 0, err
+	}
+
+	return batch, int64(headerSize + len(payload)), nil
+}
+
+// Reads a single record, verifying its checksum.
+func readRecord(reader io.Reader) ([]byte, error) {
+	header := make([]byte, headerSize)
+
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+
+		return nil, errCorrupt
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return nil, errCorrupt
+	}
+
+	payload := make([]byte, length)
+
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, errCorrupt
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errCorrupt
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,181 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/prometheus-cloudwatch/internal/storage"
+)
+
+func TestDiskReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	batch := storage.Batch{
+		Namespace: "test",
+		Data: []*cloudwatch.MetricDatum{
+			{
+				MetricName: aws.String("metric1"),
+				Values:     []*float64{aws.Float64(1)},
+			},
+		},
+	}
+
+	q, err := NewDisk(DiskParams{Path: dir})
+	assert.Nil(t, err)
+	assert.Nil(t, q.Push(batch))
+	assert.Nil(t, q.Push(batch))
+
+	entry, ok := q.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, batch, entry.Batch)
+	assert.Nil(t, q.Close())
+
+	// Batches which were not acknowledged are replayed after a restart.
+	q, err = NewDisk(DiskParams{Path: dir})
+	assert.Nil(t, err)
+	assert.Nil(t, q.Close())
+
+	var replayed int
+
+	for {
+		entry, ok := q.Pop()
+		if !ok {
+			break
+		}
+
+		assert.Equal(t, batch, entry.Batch)
+		q.Ack(entry)
+		replayed++
+	}
+
+	assert.Equal(t, 2, replayed)
+
+	// Acknowledged segments are removed.
+	q, err = NewDisk(DiskParams{Path: dir})
+	assert.Nil(t, err)
+	assert.Nil(t, q.Close())
+
+	_, ok = q.Pop()
+	assert.False(t, ok)
+}
+
+func TestDiskCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := NewDisk(DiskParams{Path: dir})
+	assert.Nil(t, err)
+	assert.Nil(t, q.Push(storage.Batch{Namespace: "one"}))
+	assert.Nil(t, q.Close())
+
+	// Simulate a crash while a record was being written.
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentExtension))
+	assert.Nil(t, err)
+
+	file, err := os.OpenFile(files[len(files)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte{0, 0, 1})
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	q, err = NewDisk(DiskParams{Path: dir})
+	assert.Nil(t, err)
+	assert.Nil(t, q.Close())
+
+	entry, ok := q.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, "one", entry.Batch.Namespace)
+
+	_, ok = q.Pop()
+	assert.False(t, ok)
+}
+
+func TestDiskMaxBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Every record is written to its own segment.
+	q, err := NewDisk(DiskParams{Path: dir, MaxBytes: 50, SegmentSize: 1})
+	assert.Nil(t, err)
+
+	assert.Nil(t, q.Push(storage.Batch{Namespace: "one"}))
+	assert.Nil(t, q.Push(storage.Batch{Namespace: "two"}))
+	assert.Nil(t, q.Push(storage.Batch{Namespace: "three"}))
+	assert.Nil(t, q.Close())
+
+	// The oldest segments are dropped to stay within the limit.
+	entry, ok := q.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, "three", entry.Batch.Namespace)
+
+	_, ok = q.Pop()
+	assert.False(t, ok)
+}
+
+func TestDiskMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Every record is written to its own segment.
+	q, err := NewDisk(DiskParams{Path: dir, MaxAge: time.Millisecond, SegmentSize: 1})
+	assert.Nil(t, err)
+
+	assert.Nil(t, q.Push(storage.Batch{Namespace: "one"}))
+	assert.Nil(t, q.Push(storage.Batch{Namespace: "two"}))
+
+	time.Sleep(10 * time.Millisecond)
+
+	// Segments which are too old are dropped when the queue is next used.
+	assert.Nil(t, q.Push(storage.Batch{Namespace: "three"}))
+	assert.Nil(t, q.Close())
+
+	entry, ok := q.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, "three", entry.Batch.Namespace)
+
+	_, ok = q.Pop()
+	assert.False(t, ok)
+}
+
+func TestDiskRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := NewDisk(DiskParams{Path: dir})
+	assert.Nil(t, err)
+	assert.Nil(t, q.Push(storage.Batch{Namespace: "one"}))
+
+	entry, ok := q.Pop()
+	assert.True(t, ok)
+
+	// The batch is popped again without a restart, with the datums which are left to push.
+	entry.Batch.Namespace = "remainder"
+	assert.Nil(t, q.Retry(entry))
+
+	entry, ok = q.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, "remainder", entry.Batch.Namespace)
+	q.Ack(entry)
+	assert.Nil(t, q.Close())
+
+	// Nothing is replayed after a restart once the retried batch has been acknowledged.
+	q, err = NewDisk(DiskParams{Path: dir})
+	assert.Nil(t, err)
+	assert.Nil(t, q.Close())
+
+	_, ok = q.Pop()
+	assert.False(t, ok)
+}
@@ -0,0 +1,104 @@
+package queue
+
+import (
+	"sync"
+
+	"github.com/skpr/prometheus-cloudwatch/internal/storage"
+)
+
+// Memory queue which holds a bounded number of batches. Push blocks while the queue is full.
+type Memory struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	closed  bool
+	size    int
+	batches []storage.Batch
+}
+
+// NewMemory queue which holds up to size batches.
+func NewMemory(size int) *Memory {
+	m := &Memory{
+		size: size,
+	}
+
+	m.cond = sync.NewCond(&m.mutex)
+
+	return m
+}
+
+// Push a batch onto the queue.
+func (m *Memory) Push(batch storage.Batch) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for !m.closed && len(m.batches) >= m.size {
+		m.cond.Wait()
+	}
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	m.push(batch)
+
+	return nil
+}
+
+// Pop the next batch from the queue.
+func (m *Memory) Pop() (*Entry, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for len(m.batches) == 0 {
+		if m.closed {
+			return nil, false
+		}
+
+		m.cond.Wait()
+	}
+
+	batch := m.batches[0]
+	m.batches = m.batches[1:]
+
+	queueDepth.Dec()
+	m.cond.Broadcast()
+
+	return &Entry{Batch: batch}, true
+}
+
+// Ack is a no-op because batches are not retained once popped.
+func (m *Memory) Ack(*Entry) {}
+
+// Retry a batch by adding it to the queue again. The size of the queue is not enforced, so a worker cannot block on
+// the queue it is consuming. The batch is not added once the queue is closed, because the workers may have exited.
+func (m *Memory) Retry(entry *Entry) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	m.push(entry.Batch)
+
+	return nil
+}
+
+// Close the queue.
+func (m *Memory) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.closed = true
+	m.cond.Broadcast()
+
+	return nil
+}
+
+// Adds a batch to the end of the queue.
+func (m *Memory) push(batch storage.Batch) {
+	m.batches = append(m.batches, batch)
+
+	queueDepth.Inc()
+	m.cond.Broadcast()
+}
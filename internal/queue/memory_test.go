@@ -0,0 +1,58 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/prometheus-cloudwatch/internal/storage"
+)
+
+func TestMemory(t *testing.T) {
+	q := NewMemory(2)
+
+	assert.Nil(t, q.Push(storage.Batch{Namespace: "one"}))
+	assert.Nil(t, q.Push(storage.Batch{Namespace: "two"}))
+	assert.Nil(t, q.Close())
+	assert.Equal(t, ErrClosed, q.Push(storage.Batch{Namespace: "three"}))
+
+	// Batches which were queued before closing can still be popped.
+	entry, ok := q.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, "one", entry.Batch.Namespace)
+	q.Ack(entry)
+
+	entry, ok = q.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, "two", entry.Batch.Namespace)
+
+	_, ok = q.Pop()
+	assert.False(t, ok)
+}
+
+func TestMemoryRetry(t *testing.T) {
+	q := NewMemory(1)
+
+	assert.Nil(t, q.Push(storage.Batch{Namespace: "one"}))
+
+	entry, ok := q.Pop()
+	assert.True(t, ok)
+
+	assert.Nil(t, q.Push(storage.Batch{Namespace: "two"}))
+
+	// Retries are queued even when the queue is full.
+	assert.Nil(t, q.Retry(entry))
+	assert.Nil(t, q.Close())
+
+	// Retries are not queued once the queue is closed, because nothing may be left to pop them.
+	assert.Equal(t, ErrClosed, q.Retry(&Entry{Batch: storage.Batch{Namespace: "three"}}))
+
+	for _, want := range []string{"two", "one"} {
+		entry, ok = q.Pop()
+		assert.True(t, ok)
+		assert.Equal(t, want, entry.Batch.Namespace)
+	}
+
+	_, ok = q.Pop()
+	assert.False(t, ok)
+}
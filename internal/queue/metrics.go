@@ -0,0 +1,44 @@
+package queue
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Namespace used for metrics describing this writer.
+const metricsNamespace = "prometheus_cloudwatch"
+
+var (
+	queueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_depth",
+		Help:      "Number of batches waiting to be pushed to CloudWatch.",
+	})
+
+	queueBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_bytes",
+		Help:      "Number of bytes used by the disk backed queue.",
+	})
+
+	droppedBatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_dropped_batches_total",
+		Help:      "Number of batches dropped from the disk backed queue, by reason.",
+	}, []string{"reason"})
+
+	walBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "wal_bytes",
+		Help:      "Number of bytes used by the write-ahead log of write requests which have not been flushed.",
+	})
+
+	walCorrupt = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "wal_corrupt_segments_total",
+		Help:      "Number of write-ahead log segments which could only be partly replayed because a record was corrupt.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(queueDepth, queueBytes, droppedBatches, walBytes, walCorrupt)
+}
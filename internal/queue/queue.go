@@ -0,0 +1,33 @@
+package queue
+
+import (
+	"errors"
+
+	"github.com/skpr/prometheus-cloudwatch/internal/storage"
+)
+
+// ErrClosed is returned when pushing to a queue which has been closed.
+var ErrClosed = errors.New("queue is closed")
+
+// Interface for a queue of batches waiting to be pushed to CloudWatch.
+type Interface interface {
+	// Push a batch onto the queue.
+	Push(storage.Batch) error
+	// Pop the next batch, blocking until one is available. Returns false once the queue is closed and empty.
+	Pop() (*Entry, bool)
+	// Ack a batch once it has been pushed to CloudWatch.
+	Ack(*Entry)
+	// Retry a batch which could not be pushed, so it is popped again without waiting for a restart. The batch of the
+	// entry can be replaced with the datums which are left to push. Returns ErrClosed once the queue has been closed.
+	Retry(*Entry) error
+	// Close the queue. Batches which are already queued can still be popped.
+	Close() error
+}
+
+// Entry which has been popped from a queue.
+type Entry struct {
+	Batch storage.Batch
+
+	// Segment the entry was read from when using a disk backed queue.
+	segment uint64
+}
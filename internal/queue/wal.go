@@ -0,0 +1,279 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Extension for write-ahead log segment files.
+const walExtension = ".wal"
+
+// WAL which write requests are appended to before they are acknowledged, so requests which are still being aggregated
+// survive a restart. Requests are replayed after a restart until a checkpoint shows that the batches they were
+// aggregated into have been queued.
+type WAL struct {
+	path     string
+	mutex    sync.Mutex
+	sequence uint64
+	head     *os.File
+	// Size of each segment by sequence.
+	sizes map[uint64]int64
+}
+
+// NewWAL which stores segments in the given directory. Segments which already exist are kept until they are replayed
+// and truncated.
+func NewWAL(path string) (*WAL, error) {
+	if path == "" {
+		return nil, errors.New("path was not provided")
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	wal := &WAL{
+		path:  path,
+		sizes: make(map[uint64]int64),
+	}
+
+	for _, file := range files {
+		sequence, ok := walSequence(file.Name())
+		if !ok {
+			continue
+		}
+
+		if sequence > wal.sequence {
+			wal.sequence = sequence
+		}
+
+		wal.sizes[sequence] = file.Size()
+	}
+
+	if err := wal.rotate(); err != nil {
+		return nil, err
+	}
+
+	return wal, nil
+}
+
+// Append a request to the log. The request has been synced to disk once this returns.
+func (w *WAL) Append(req prompb.WriteRequest) error {
+	payload, err := req.Marshal()
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[headerSize:], payload)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.head == nil {
+		return ErrClosed
+	}
+
+	if _, err := w.head.Write(record); err != nil {
+		// Discard the partial record and start again with a fresh segment.
+		os.Truncate(w.segmentPath(w.sequence), w.sizes[w.sequence])
+		w.rotate()
+		return err
+	}
+
+	if err := w.head.Sync(); err != nil {
+		return err
+	}
+
+	w.sizes[w.sequence] += int64(len(record))
+	w.updateMetrics()
+
+	return nil
+}
+
+// Replay the requests in every segment written before the log was opened, oldest first. A segment is only replayed up
+// to the first record which is corrupt.
+func (w *WAL) Replay(fn func(prompb.WriteRequest)) error {
+	w.mutex.Lock()
+	head := w.sequence
+	w.mutex.Unlock()
+
+	for _, sequence := range w.segments() {
+		if sequence >= head {
+			continue
+		}
+
+		if err := w.replay(sequence, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Checkpoint starts a new segment and returns its sequence. Once every request appended before the checkpoint has
+// been flushed, the segments before it can be removed with Truncate.
+func (w *WAL) Checkpoint() (uint64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.head == nil {
+		return 0, ErrClosed
+	}
+
+	if err := w.rotate(); err != nil {
+		return 0, err
+	}
+
+	return w.sequence, nil
+}
+
+// Truncate removes the segments before a checkpoint.
+func (w *WAL) Truncate(checkpoint uint64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, sequence := range w.segments() {
+		if sequence >= checkpoint {
+			continue
+		}
+
+		if err := os.Remove(w.segmentPath(sequence)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		delete(w.sizes, sequence)
+	}
+
+	w.updateMetrics()
+
+	return nil
+}
+
+// Close the log.
+func (w *WAL) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.head == nil {
+		return nil
+	}
+
+	err := w.head.Close()
+	w.head = nil
+
+	return err
+}
+
+// Starts a new head segment.
+func (w *WAL) rotate() error {
+	if w.head != nil {
+		w.head.Close()
+	}
+
+	w.sequence++
+
+	file, err := os.OpenFile(w.segmentPath(w.sequence), os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_TRUNC, 0644)
+	if err != nil {
+		w.head = nil
+		return err
+	}
+
+	w.head = file
+	w.sizes[w.sequence] = 0
+
+	return nil
+}
+
+// Replays the requests in a single segment.
+func (w *WAL) replay(sequence uint64, fn func(prompb.WriteRequest)) error {
+	file, err := os.Open(w.segmentPath(sequence))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+
+	for {
+		payload, err := readRecord(reader)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			walCorrupt.Inc()
+			return nil
+		}
+
+		var req prompb.WriteRequest
+
+		if err := req.Unmarshal(payload); err != nil {
+			walCorrupt.Inc()
+			return nil
+		}
+
+		fn(req)
+	}
+}
+
+// Sequences of the segments on disk, oldest first.
+func (w *WAL) segments() []uint64 {
+	var sequences []uint64
+
+	for sequence := range w.sizes {
+		sequences = append(sequences, sequence)
+	}
+
+	sort.Slice(sequences, func(i, j int) bool {
+		return sequences[i] < sequences[j]
+	})
+
+	return sequences
+}
+
+// Path of a segment.
+func (w *WAL) segmentPath(sequence uint64) string {
+	return filepath.Join(w.path, fmt.Sprintf("%020d%s", sequence, walExtension))
+}
+
+// Publishes the size of the log.
+func (w *WAL) updateMetrics() {
+	var size int64
+
+	for _, s := range w.sizes {
+		size += s
+	}
+
+	walBytes.Set(float64(size))
+}
+
+// Sequence of a segment file.
+func walSequence(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, walExtension) {
+		return 0, false
+	}
+
+	sequence, err := strconv.ParseUint(strings.TrimSuffix(name, walExtension), 10, 64)
+
+	return sequence, err == nil
+}
@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	req := prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels:  []prompb.Label{{Name: model.MetricNameLabel, Value: "metric1"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+			},
+		},
+	}
+
+	wal, err := NewWAL(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Append(req))
+	assert.Nil(t, wal.Append(req))
+	assert.Nil(t, wal.Close())
+
+	// Requests which were appended before a restart are replayed.
+	wal, err = NewWAL(dir)
+	assert.Nil(t, err)
+
+	var replayed []prompb.WriteRequest
+
+	assert.Nil(t, wal.Replay(func(req prompb.WriteRequest) {
+		replayed = append(replayed, req)
+	}))
+
+	assert.Len(t, replayed, 2)
+	assert.Equal(t, req.Timeseries[0].Labels, replayed[0].Timeseries[0].Labels)
+	assert.Equal(t, req.Timeseries[0].Samples, replayed[0].Timeseries[0].Samples)
+
+	// Requests appended after a checkpoint are kept when it is truncated.
+	checkpoint, err := wal.Checkpoint()
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Append(req))
+	assert.Nil(t, wal.Truncate(checkpoint))
+	assert.Nil(t, wal.Close())
+
+	wal, err = NewWAL(dir)
+	assert.Nil(t, err)
+
+	replayed = nil
+
+	assert.Nil(t, wal.Replay(func(req prompb.WriteRequest) {
+		replayed = append(replayed, req)
+	}))
+
+	assert.Len(t, replayed, 1)
+	assert.Nil(t, wal.Close())
+}
@@ -0,0 +1,270 @@
+package relabel
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Action which is performed by a relabel config.
+type Action string
+
+const (
+	// Replace the target label with the replacement when the regex matches the concatenated source labels.
+	Replace Action = "replace"
+	// Keep the series only when the regex matches the concatenated source labels.
+	Keep Action = "keep"
+	// Drop the series when the regex matches the concatenated source labels.
+	Drop Action = "drop"
+	// HashMod sets the target label to the modulus of a hash of the concatenated source labels.
+	HashMod Action = "hashmod"
+	// LabelMap copies the value of every label which matches the regex to the label named by the replacement.
+	LabelMap Action = "labelmap"
+	// LabelDrop removes every label which matches the regex.
+	LabelDrop Action = "labeldrop"
+	// LabelKeep removes every label which does not match the regex.
+	LabelKeep Action = "labelkeep"
+)
+
+var (
+	// DefaultConfig which a relabel config is unmarshalled on top of, the same as Prometheus.
+	DefaultConfig = Config{
+		Action:      Replace,
+		Separator:   ";",
+		Regex:       MustNewRegexp("(.*)"),
+		Replacement: "$1",
+	}
+
+	// Label names which can include references to regex capture groups.
+	relabelTarget = regexp.MustCompile(`^(?:(?:[a-zA-Z_]|\$(?:\{\w+\}|\w+))+\w*)+$`)
+)
+
+// Config for relabelling a series, in the same format as Prometheus write_relabel_configs.
+type Config struct {
+	// Labels whose values are concatenated with the separator and matched against the regex.
+	SourceLabels []string `json:"source_labels" yaml:"source_labels,flow"`
+	Separator    string   `json:"separator"     yaml:"separator"`
+	Regex        Regexp   `json:"regex"         yaml:"regex"`
+	// Modulus to take of the hash of the source label values.
+	Modulus uint64 `json:"modulus" yaml:"modulus"`
+	// Label which the result is written to for the replace and hashmod actions.
+	TargetLabel string `json:"target_label" yaml:"target_label"`
+	// Replacement which regex capture groups are expanded in eg. $1.
+	Replacement string `json:"replacement" yaml:"replacement"`
+	Action      Action `json:"action"      yaml:"action"`
+}
+
+// UnmarshalYAML applies the defaults to any fields which have not been set.
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultConfig
+
+	type plain Config
+
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	return c.Validate()
+}
+
+// Validate the configuration for an action.
+func (c *Config) Validate() error {
+	if c.Regex.Regexp == nil {
+		return fmt.Errorf("relabel regex was not provided")
+	}
+
+	switch c.Action {
+	case Replace, HashMod:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel action %s requires target_label", c.Action)
+		}
+
+		if c.Action == Replace && !validTarget(c.TargetLabel) {
+			return fmt.Errorf("relabel target_label is invalid: %s", c.TargetLabel)
+		}
+
+		if c.Action == HashMod && c.Modulus == 0 {
+			return fmt.Errorf("relabel action %s requires modulus", c.Action)
+		}
+
+		if c.Action == HashMod && !model.LabelName(c.TargetLabel).IsValid() {
+			return fmt.Errorf("relabel target_label is invalid: %s", c.TargetLabel)
+		}
+	case LabelMap:
+		if !validTarget(c.Replacement) {
+			return fmt.Errorf("relabel replacement is invalid: %s", c.Replacement)
+		}
+	case LabelDrop, LabelKeep:
+		if len(c.SourceLabels) > 0 || c.TargetLabel != "" || c.Modulus != 0 || c.Separator != DefaultConfig.Separator || c.Replacement != DefaultConfig.Replacement {
+			return fmt.Errorf("relabel action %s only supports regex", c.Action)
+		}
+	case Keep, Drop:
+	default:
+		return fmt.Errorf("relabel action not supported: %s", c.Action)
+	}
+
+	return nil
+}
+
+// Regexp which must match the whole of a value.
+type Regexp struct {
+	*regexp.Regexp
+	original string
+}
+
+// NewRegexp which is anchored at both ends.
+func NewRegexp(s string) (Regexp, error) {
+	re, err := regexp.Compile("^(?:" + s + ")$")
+	return Regexp{Regexp: re, original: s}, err
+}
+
+// MustNewRegexp panics if the regex is invalid.
+func MustNewRegexp(s string) Regexp {
+	re, err := NewRegexp(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return re
+}
+
+// UnmarshalYAML compiles the regex.
+func (re *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	r, err := NewRegexp(s)
+	if err != nil {
+		return err
+	}
+
+	*re = r
+
+	return nil
+}
+
+// MarshalYAML returns the regex as it was configured.
+func (re Regexp) MarshalYAML() (interface{}, error) {
+	return re.original, nil
+}
+
+// Process a set of labels with each config in turn. Returns nil if the series has been dropped. Labels with an empty
+// value are removed, the same as Prometheus.
+func Process(labels []prompb.Label, configs ...*Config) []prompb.Label {
+	set := make(map[string]string, len(labels))
+
+	for _, label := range labels {
+		set[label.Name] = label.Value
+	}
+
+	for _, config := range configs {
+		if !process(set, config) {
+			return nil
+		}
+	}
+
+	result := make([]prompb.Label, 0, len(set))
+
+	for name, value := range set {
+		if value == "" {
+			continue
+		}
+
+		result = append(result, prompb.Label{Name: name, Value: value})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result
+}
+
+// Applies a single config to a set of labels, returning false if the series has been dropped.
+func process(set map[string]string, config *Config) bool {
+	values := make([]string, len(config.SourceLabels))
+
+	for i, name := range config.SourceLabels {
+		values[i] = set[name]
+	}
+
+	value := strings.Join(values, config.Separator)
+
+	switch config.Action {
+	case Drop:
+		if config.Regex.MatchString(value) {
+			return false
+		}
+	case Keep:
+		if !config.Regex.MatchString(value) {
+			return false
+		}
+	case Replace:
+		indexes := config.Regex.FindStringSubmatchIndex(value)
+		if indexes == nil {
+			break
+		}
+
+		target := string(config.Regex.ExpandString([]byte{}, config.TargetLabel, value, indexes))
+		if !model.LabelName(target).IsValid() {
+			delete(set, config.TargetLabel)
+			break
+		}
+
+		result := config.Regex.ExpandString([]byte{}, config.Replacement, value, indexes)
+		if len(result) == 0 {
+			delete(set, target)
+			break
+		}
+
+		set[target] = string(result)
+	case HashMod:
+		sum := md5.Sum([]byte(value))
+		set[config.TargetLabel] = fmt.Sprintf("%d", binary.BigEndian.Uint64(sum[8:])%config.Modulus)
+	case LabelMap:
+		for name, value := range copyLabels(set) {
+			if config.Regex.MatchString(name) {
+				set[config.Regex.ReplaceAllString(name, config.Replacement)] = value
+			}
+		}
+	case LabelDrop:
+		for name := range copyLabels(set) {
+			if config.Regex.MatchString(name) {
+				delete(set, name)
+			}
+		}
+	case LabelKeep:
+		for name := range copyLabels(set) {
+			if !config.Regex.MatchString(name) {
+				delete(set, name)
+			}
+		}
+	}
+
+	return true
+}
+
+// Copies labels so they can be modified while being iterated over.
+func copyLabels(set map[string]string) map[string]string {
+	copied := make(map[string]string, len(set))
+
+	for name, value := range set {
+		copied[name] = value
+	}
+
+	return copied
+}
+
+// Reports whether a target label is valid, allowing for references to regex capture groups eg. ${1}.
+func validTarget(target string) bool {
+	return relabelTarget.MatchString(target)
+}
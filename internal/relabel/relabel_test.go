@@ -0,0 +1,181 @@
+package relabel
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestProcess(t *testing.T) {
+	labels := []prompb.Label{
+		{Name: "__name__", Value: "http_requests_total"},
+		{Name: "code", Value: "500"},
+		{Name: "kubernetes_namespace", Value: "prod"},
+		{Name: "kubernetes_pod_name", Value: "web-1"},
+	}
+
+	tests := []struct {
+		name   string
+		config string
+		want   []prompb.Label
+	}{
+		{
+			name: "replace",
+			config: `
+source_labels: [kubernetes_namespace]
+target_label: Namespace
+`,
+			want: []prompb.Label{
+				{Name: "Namespace", Value: "prod"},
+				{Name: "__name__", Value: "http_requests_total"},
+				{Name: "code", Value: "500"},
+				{Name: "kubernetes_namespace", Value: "prod"},
+				{Name: "kubernetes_pod_name", Value: "web-1"},
+			},
+		},
+		{
+			name: "replace composite",
+			config: `
+source_labels: [kubernetes_namespace, kubernetes_pod_name]
+separator: /
+regex: (.+)/(.+)
+target_label: instance
+replacement: $1:$2
+`,
+			want: []prompb.Label{
+				{Name: "__name__", Value: "http_requests_total"},
+				{Name: "code", Value: "500"},
+				{Name: "instance", Value: "prod:web-1"},
+				{Name: "kubernetes_namespace", Value: "prod"},
+				{Name: "kubernetes_pod_name", Value: "web-1"},
+			},
+		},
+		{
+			name: "replace name",
+			config: `
+source_labels: [__name__]
+regex: (.+)_total
+target_label: __name__
+replacement: ${1}_count
+`,
+			want: []prompb.Label{
+				{Name: "__name__", Value: "http_requests_count"},
+				{Name: "code", Value: "500"},
+				{Name: "kubernetes_namespace", Value: "prod"},
+				{Name: "kubernetes_pod_name", Value: "web-1"},
+			},
+		},
+		{
+			name: "replace no match",
+			config: `
+source_labels: [code]
+regex: 2..
+target_label: success
+replacement: "true"
+`,
+			want: labels,
+		},
+		{
+			name: "keep",
+			config: `
+source_labels: [kubernetes_namespace]
+regex: prod|staging
+action: keep
+`,
+			want: labels,
+		},
+		{
+			name: "keep no match",
+			config: `
+source_labels: [kubernetes_namespace]
+regex: dev
+action: keep
+`,
+		},
+		{
+			name: "drop",
+			config: `
+source_labels: [code]
+regex: 5..
+action: drop
+`,
+		},
+		{
+			name: "labelmap",
+			config: `
+regex: kubernetes_(.+)
+action: labelmap
+`,
+			want: []prompb.Label{
+				{Name: "__name__", Value: "http_requests_total"},
+				{Name: "code", Value: "500"},
+				{Name: "kubernetes_namespace", Value: "prod"},
+				{Name: "kubernetes_pod_name", Value: "web-1"},
+				{Name: "namespace", Value: "prod"},
+				{Name: "pod_name", Value: "web-1"},
+			},
+		},
+		{
+			name: "labeldrop",
+			config: `
+regex: kubernetes_.+
+action: labeldrop
+`,
+			want: []prompb.Label{
+				{Name: "__name__", Value: "http_requests_total"},
+				{Name: "code", Value: "500"},
+			},
+		},
+		{
+			name: "labelkeep",
+			config: `
+regex: __name__|code
+action: labelkeep
+`,
+			want: []prompb.Label{
+				{Name: "__name__", Value: "http_requests_total"},
+				{Name: "code", Value: "500"},
+			},
+		},
+		{
+			name: "hashmod",
+			config: `
+source_labels: [kubernetes_pod_name]
+modulus: 8
+target_label: shard
+action: hashmod
+`,
+			want: []prompb.Label{
+				{Name: "__name__", Value: "http_requests_total"},
+				{Name: "code", Value: "500"},
+				{Name: "kubernetes_namespace", Value: "prod"},
+				{Name: "kubernetes_pod_name", Value: "web-1"},
+				{Name: "shard", Value: "0"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		var config Config
+
+		assert.Nil(t, yaml.Unmarshal([]byte(test.config), &config), test.name)
+		assert.Equal(t, test.want, Process(labels, &config), test.name)
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	for _, config := range []string{
+		"regex: '('",
+		"action: unknown",
+		"action: replace",
+		"action: replace\ntarget_label: 1abc",
+		"action: hashmod\ntarget_label: shard",
+		"action: labelmap\nreplacement: 1abc",
+		"action: labeldrop\ntarget_label: foo",
+	} {
+		var c Config
+		assert.Error(t, yaml.Unmarshal([]byte(config), &c), config)
+	}
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+const (
+	// MaxBatchDatums which CloudWatch accepts in a single PutMetricData request.
+	MaxBatchDatums = 1000
+	// MaxBatchBytes which CloudWatch accepts for the payload of a single PutMetricData request.
+	MaxBatchBytes = 1 << 20
+
+	// Allows for the parts of a request which are not estimated eg. the signature headers.
+	batchOverhead = 4 << 10
+	// Longest member prefix of a datum field eg. MetricData.member.1000.Dimensions.member.10.Value=&.
+	fieldOverhead = 56
+)
+
+// Splits datums into batches which stay within the datum count and payload size limits of a request.
+type batcher struct {
+	max     int
+	bytes   int
+	batches []Batch
+	size    int
+}
+
+// New batcher with the maximum number of datums in a batch.
+func newBatcher(max int) *batcher {
+	if max <= 0 || max > MaxBatchDatums {
+		max = MaxBatchDatums
+	}
+
+	return &batcher{
+		max:   max,
+		bytes: MaxBatchBytes - batchOverhead,
+	}
+}
+
+// Adds a datum and the labels of the series it came from to the batch for its namespace, starting a new batch when the
+// datum would not fit. A datum which is too large to fit in a request by itself has its values split across several
+// datums.
+func (b *batcher) add(namespace string, datum *cloudwatch.MetricDatum, labels []Labels) {
+	size := datumSize(datum)
+
+	if size > b.bytes-requestSize(namespace) && len(datum.Values) > 1 {
+		for _, split := range splitValues(datum, (len(datum.Values)+1)/2) {
+			b.add(namespace, split, labels)
+		}
+
+		return
+	}
+
+	last := len(b.batches) - 1
+
+	if last < 0 || b.batches[last].Namespace != namespace || len(b.batches[last].Data) >= b.max || b.size+size > b.bytes {
+		b.batches = append(b.batches, Batch{Namespace: namespace})
+		b.size = requestSize(namespace)
+		last++
+	}
+
+	b.batches[last].Data = append(b.batches[last].Data, datum)
+	b.batches[last].Labels = append(b.batches[last].Labels, labels)
+	b.size += size
+}
+
+// Size of the parts of a request which are not datums.
+func requestSize(namespace string) int {
+	return len("Action=PutMetricData&Version=2010-08-01&Namespace=") + len(url.QueryEscape(namespace))
+}
+
+// Estimates the size of a datum once it has been encoded in a request. Requests are form encoded with a prefix for
+// every field, which is estimated at its longest.
+func datumSize(datum *cloudwatch.MetricDatum) int {
+	size := fieldSize(url.QueryEscape(aws.StringValue(datum.MetricName)))
+
+	for _, dimension := range datum.Dimensions {
+		size += fieldSize(url.QueryEscape(aws.StringValue(dimension.Name)))
+		size += fieldSize(url.QueryEscape(aws.StringValue(dimension.Value)))
+	}
+
+	if datum.Timestamp != nil {
+		size += fieldSize(datum.Timestamp.Format("2006-01-02T15:04:05Z"))
+	}
+
+	if datum.Unit != nil {
+		size += fieldSize(*datum.Unit)
+	}
+
+	if datum.StorageResolution != nil {
+		size += fieldSize(strconv.FormatInt(*datum.StorageResolution, 10))
+	}
+
+	if datum.Value != nil {
+		size += floatSize(*datum.Value)
+	}
+
+	if set := datum.StatisticValues; set != nil {
+		for _, value := range []*float64{set.Minimum, set.Maximum, set.Sum, set.SampleCount} {
+			size += floatSize(aws.Float64Value(value))
+		}
+	}
+
+	for _, value := range datum.Values {
+		size += floatSize(*value)
+	}
+
+	for _, count := range datum.Counts {
+		size += floatSize(*count)
+	}
+
+	return size
+}
+
+// Size of a field once it has been encoded.
+func fieldSize(value string) int {
+	return fieldOverhead + len(value)
+}
+
+// Size of a number once it has been encoded.
+func floatSize(value float64) int {
+	return fieldSize(strconv.FormatFloat(value, 'g', -1, 64))
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatcherCount(t *testing.T) {
+	tests := []struct {
+		max  int
+		want []int
+	}{
+		{max: 2, want: []int{2, 2, 1}},
+		{max: 0, want: []int{5}},
+		{max: MaxBatchDatums + 1, want: []int{5}},
+	}
+
+	for _, test := range tests {
+		b := newBatcher(test.max)
+
+		for i := 0; i < 5; i++ {
+			b.add("Prometheus", &cloudwatch.MetricDatum{MetricName: aws.String(fmt.Sprintf("metric%d", i))}, nil)
+		}
+
+		var sizes []int
+
+		for _, batch := range b.batches {
+			sizes = append(sizes, len(batch.Data))
+		}
+
+		assert.Equal(t, test.want, sizes, test.max)
+	}
+}
+
+func TestBatcherNamespace(t *testing.T) {
+	b := newBatcher(10)
+
+	b.add("Prometheus", &cloudwatch.MetricDatum{MetricName: aws.String("metric1")}, nil)
+	b.add("Prometheus", &cloudwatch.MetricDatum{MetricName: aws.String("metric2")}, nil)
+	b.add("Other", &cloudwatch.MetricDatum{MetricName: aws.String("metric3")}, nil)
+
+	assert.Len(t, b.batches, 2)
+	assert.Equal(t, "Prometheus", b.batches[0].Namespace)
+	assert.Len(t, b.batches[0].Data, 2)
+	assert.Equal(t, "Other", b.batches[1].Namespace)
+	assert.Len(t, b.batches[1].Data, 1)
+}
+
+func TestBatcherSize(t *testing.T) {
+	b := newBatcher(MaxBatchDatums)
+
+	// Each datum is roughly 30KB once encoded, so a request holds about 30 of them.
+	for i := 0; i < 100; i++ {
+		datum := &cloudwatch.MetricDatum{MetricName: aws.String(fmt.Sprintf("metric%d", i))}
+
+		for j := 0; j < MaxDimensions; j++ {
+			datum.Dimensions = append(datum.Dimensions, &cloudwatch.Dimension{
+				Name:  aws.String(fmt.Sprintf("dimension%d", j)),
+				Value: aws.String(strings.Repeat("x", MaxNameLength)),
+			})
+		}
+
+		for j := 0; j < MaxValues; j++ {
+			datum.Values = append(datum.Values, aws.Float64(0.123456789012345))
+			datum.Counts = append(datum.Counts, aws.Float64(1))
+		}
+
+		b.add("Prometheus", datum, nil)
+	}
+
+	assert.True(t, len(b.batches) > 1)
+
+	var total int
+
+	for _, batch := range b.batches {
+		size := requestSize(batch.Namespace)
+
+		for _, datum := range batch.Data {
+			size += datumSize(datum)
+		}
+
+		assert.True(t, size <= MaxBatchBytes, "batch is within the payload limit")
+
+		total += len(batch.Data)
+	}
+
+	assert.Equal(t, 100, total)
+}
+
+func TestBatcherSplit(t *testing.T) {
+	b := newBatcher(MaxBatchDatums)
+
+	datum := &cloudwatch.MetricDatum{MetricName: aws.String("metric1")}
+
+	// Far more values than fit in a single request.
+	for i := 0; i < 20000; i++ {
+		datum.Values = append(datum.Values, aws.Float64(float64(i)+0.5))
+		datum.Counts = append(datum.Counts, aws.Float64(1))
+	}
+
+	b.add("Prometheus", datum, []Labels{{"__name__": "metric1"}})
+
+	assert.True(t, len(b.batches) > 1)
+
+	var values []*float64
+
+	for _, batch := range b.batches {
+		size := requestSize(batch.Namespace)
+
+		assert.Len(t, batch.Labels, len(batch.Data))
+
+		for _, split := range batch.Data {
+			assert.Equal(t, "metric1", *split.MetricName)
+			assert.Equal(t, len(split.Values), len(split.Counts))
+
+			size += datumSize(split)
+			values = append(values, split.Values...)
+		}
+
+		assert.True(t, size <= MaxBatchBytes, "batch is within the payload limit")
+	}
+
+	assert.Equal(t, datum.Values, values)
+}
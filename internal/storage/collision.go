@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"fmt"
+)
+
+const (
+	// CollisionDistribution keeps the samples of every series which collided, so they are pushed as a distribution.
+	CollisionDistribution = "distribution"
+	// CollisionSum adds the values of the series which collided.
+	CollisionSum = RollupSum
+	// CollisionMin takes the lowest value of the series which collided.
+	CollisionMin = RollupMin
+	// CollisionMax takes the highest value of the series which collided.
+	CollisionMax = RollupMax
+	// CollisionLast keeps the samples of the series which was added last.
+	CollisionLast = "last"
+)
+
+// Validates a collision policy.
+func validateCollision(collision string) error {
+	switch collision {
+	case CollisionDistribution, CollisionSum, CollisionMin, CollisionMax, CollisionLast:
+		return nil
+	}
+
+	return fmt.Errorf("collision policy not supported: %s", collision)
+}
+
+// Adds samples from a Prometheus series, counting a collision when they come from a series which has not been seen
+// for this datum before.
+func (s *series) add(member string, values []float64) {
+	if s.members == nil {
+		s.members = make(map[string][]float64)
+	}
+
+	if _, ok := s.members[member]; !ok && len(s.members) > 0 {
+		seriesCollisions.WithLabelValues(s.collision).Inc()
+	}
+
+	s.members[member] = append(s.members[member], values...)
+	s.last = member
+}
+
+// Samples which are pushed for the datum, resolving any collisions with the policy.
+func (s *series) samples() []float64 {
+	if len(s.members) == 0 {
+		return s.values
+	}
+
+	if len(s.members) == 1 {
+		return s.members[s.last]
+	}
+
+	switch s.collision {
+	case CollisionLast:
+		return s.members[s.last]
+	case CollisionSum, CollisionMin, CollisionMax:
+		return []float64{combine(s.members, s.delta, s.collision)}
+	}
+
+	var values []float64
+
+	for _, samples := range s.members {
+		values = append(values, samples...)
+	}
+
+	return values
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+
+	mocklog "github.com/skpr/prometheus-cloudwatch/internal/storage/mock/log"
+	storageutils "github.com/skpr/prometheus-cloudwatch/internal/storage/utils"
+)
+
+func TestCollision(t *testing.T) {
+	tests := []struct {
+		collision string
+		want      []*float64
+	}{
+		{CollisionDistribution, []*float64{aws.Float64(1), aws.Float64(3), aws.Float64(4)}},
+		{CollisionSum, []*float64{aws.Float64(6)}},
+		{CollisionMin, []*float64{aws.Float64(2)}},
+		{CollisionMax, []*float64{aws.Float64(4)}},
+		{CollisionLast, []*float64{aws.Float64(4)}},
+	}
+
+	for _, test := range tests {
+		now := storageutils.Timestamp(time.Now())
+
+		client, err := New(mocklog.New(), "test", 10, Whitelist{
+			Metrics: []Metric{{Name: "metric1", Collision: test.collision}},
+			Labels:  []string{"job"},
+		})
+		assert.Nil(t, err)
+
+		// Both instances collapse into a single datum once the instance label is dropped.
+		for _, series := range []struct {
+			instance string
+			values   []float64
+		}{
+			{"a", []float64{1, 3}},
+			{"b", []float64{4}},
+		} {
+			var samples []prompb.Sample
+
+			for _, value := range series.values {
+				samples = append(samples, prompb.Sample{Value: value, Timestamp: now})
+			}
+
+			err = client.Add(prompb.TimeSeries{
+				Labels: []prompb.Label{
+					{Name: model.MetricNameLabel, Value: "metric1"},
+					{Name: "job", Value: "web"},
+					{Name: "instance", Value: series.instance},
+				},
+				Samples: samples,
+			})
+			assert.Nil(t, err)
+		}
+
+		batches := client.Flush()
+		assert.Len(t, batches, 1, test.collision)
+		assert.Len(t, batches[0].Data, 1, test.collision)
+		assert.Equal(t, test.want, batches[0].Data[0].Values, test.collision)
+	}
+}
+
+func TestCollisionInvalid(t *testing.T) {
+	_, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics:   []Metric{{Name: "metric1"}},
+		Labels:    []string{"job"},
+		Collision: "median",
+	})
+	assert.Error(t, err)
+
+	assert.Error(t, Metric{Name: "metric1", Collision: "median"}.Validate())
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	storageutils "github.com/skpr/prometheus-cloudwatch/internal/storage/utils"
+)
+
+// State kept for a counter so the next sample can be converted into a rate or delta.
+type counter struct {
+	value     float64
+	timestamp int64
+	seen      time.Time
+}
+
+// Converts the samples of a counter into rates or deltas. The first sample of a new series is dropped because there is
+// nothing to compare it to. A decrease is treated as a reset, the same as Prometheus, so the increase is the new value.
+// Must be called while holding the client mutex.
+func (c *Client) convertCounter(ts prompb.TimeSeries, conversion string, now time.Time) prompb.TimeSeries {
+	samples := make([]prompb.Sample, len(ts.Samples))
+	copy(samples, ts.Samples)
+
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Timestamp < samples[j].Timestamp
+	})
+
+	key := storageutils.LabelsKey(ts.Labels)
+
+	converted := prompb.TimeSeries{
+		Labels: ts.Labels,
+	}
+
+	for _, sample := range samples {
+		if math.IsNaN(sample.Value) {
+			// The series has disappeared, so it starts again from the next sample.
+			if math.Float64bits(sample.Value) == staleNaN {
+				delete(c.counters, key)
+			}
+
+			converted.Samples = append(converted.Samples, sample)
+			continue
+		}
+
+		previous, ok := c.counters[key]
+		if !ok {
+			c.counters[key] = &counter{
+				value:     sample.Value,
+				timestamp: sample.Timestamp,
+				seen:      now,
+			}
+
+			samplesDropped.WithLabelValues(reasonCounterFirst).Inc()
+
+			continue
+		}
+
+		if sample.Timestamp <= previous.timestamp {
+			samplesDropped.WithLabelValues(reasonOutOfOrder).Inc()
+			continue
+		}
+
+		increase := sample.Value - previous.value
+		if sample.Value < previous.value {
+			counterResets.Inc()
+			increase = sample.Value
+		}
+
+		value := increase
+
+		if conversion == CounterRate {
+			value = increase / (float64(sample.Timestamp-previous.timestamp) / 1000)
+		}
+
+		converted.Samples = append(converted.Samples, prompb.Sample{
+			Value:     value,
+			Timestamp: sample.Timestamp,
+		})
+
+		previous.value = sample.Value
+		previous.timestamp = sample.Timestamp
+		previous.seen = now
+	}
+
+	return converted
+}
+
+// Discards state for counters which have not been seen recently.
+// Must be called while holding the client mutex.
+func (c *Client) expireCounters(now time.Time) {
+	for key, state := range c.counters {
+		if now.Sub(state.seen) > CounterExpiry {
+			delete(c.counters, key)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"math"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+
+	mocklog "github.com/skpr/prometheus-cloudwatch/internal/storage/mock/log"
+	storageutils "github.com/skpr/prometheus-cloudwatch/internal/storage/utils"
+)
+
+func TestCounter(t *testing.T) {
+	labels := []prompb.Label{
+		{
+			Name:  model.MetricNameLabel,
+			Value: "requests_total",
+		},
+		{
+			Name:  "foo",
+			Value: "bar",
+		},
+	}
+
+	tests := []struct {
+		counter string
+		want    []*float64
+	}{
+		{
+			counter: CounterDelta,
+			// 10 -> 40 -> reset to 5 -> 25
+			want: []*float64{aws.Float64(5), aws.Float64(20), aws.Float64(30)},
+		},
+		{
+			counter: CounterRate,
+			// Samples are 10 seconds apart.
+			want: []*float64{aws.Float64(0.5), aws.Float64(2), aws.Float64(3)},
+		},
+	}
+
+	for _, tt := range tests {
+		client, err := New(mocklog.New(), "test", 10, Whitelist{
+			Metrics: []Metric{{Name: "requests_total", Counter: tt.counter}},
+			Labels:  []string{"foo"},
+		})
+		assert.Nil(t, err)
+
+		// Timestamps are aligned so every sample falls within the same period.
+		now := storageutils.Timestamp(client.(*Client).now().Truncate(StandardResolution))
+
+		// The first sample of a new series is only used as a starting point.
+		assert.Nil(t, client.Add(prompb.TimeSeries{
+			Labels: labels,
+			Samples: []prompb.Sample{
+				{
+					Value:     10,
+					Timestamp: now,
+				},
+			},
+		}))
+
+		assert.Empty(t, client.Flush())
+
+		assert.Nil(t, client.Add(prompb.TimeSeries{
+			Labels: labels,
+			Samples: []prompb.Sample{
+				{
+					Value:     40,
+					Timestamp: now + 10000,
+				},
+				{
+					Value:     5,
+					Timestamp: now + 20000,
+				},
+				{
+					Value:     25,
+					Timestamp: now + 30000,
+				},
+			},
+		}))
+
+		batches := client.Flush()
+		assert.Len(t, batches, 1)
+		assert.Len(t, batches[0].Data, 1)
+		assert.Equal(t, tt.want, batches[0].Data[0].Values, tt.counter)
+	}
+}
+
+func TestCounterInvalid(t *testing.T) {
+	_, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics: []Metric{{Name: "requests_total", Counter: "increase"}},
+		Labels:  []string{"foo"},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestCounterStale(t *testing.T) {
+	client, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics: []Metric{{Name: "requests_total", Counter: CounterDelta}},
+		Labels:  []string{"foo"},
+	})
+	assert.Nil(t, err)
+
+	now := storageutils.Timestamp(client.(*Client).now().Truncate(StandardResolution))
+
+	// The series starts again after a staleness marker, so the sample after it is only used as a starting point.
+	assert.Nil(t, client.Add(prompb.TimeSeries{
+		Labels: []prompb.Label{
+			{Name: model.MetricNameLabel, Value: "requests_total"},
+			{Name: "foo", Value: "bar"},
+		},
+		Samples: []prompb.Sample{
+			{Value: 10, Timestamp: now},
+			{Value: 20, Timestamp: now + 1000},
+			{Value: math.Float64frombits(staleNaN), Timestamp: now + 2000},
+			{Value: 100, Timestamp: now + 3000},
+			{Value: 105, Timestamp: now + 4000},
+		},
+	}))
+
+	batches := client.Flush()
+	assert.Len(t, batches, 1)
+	assert.Equal(t, []*float64{aws.Float64(5), aws.Float64(10)}, batches[0].Data[0].Values)
+}
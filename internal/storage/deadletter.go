@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"sort"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// DeadLetter sink for datums which CloudWatch refused permanently or which used up their retry budget.
+type DeadLetter interface {
+	Write(...DeadLetterEntry) error
+}
+
+// DeadLetterEntry for a datum which could not be pushed to CloudWatch.
+type DeadLetterEntry struct {
+	Namespace string                  `json:"namespace"`
+	Datum     *cloudwatch.MetricDatum `json:"datum"`
+	// Error code returned by CloudWatch.
+	Code string `json:"code"`
+	// Labels of the Prometheus series the datum came from, as they were received before relabelling.
+	Labels []Labels `json:"labels,omitempty"`
+}
+
+// Labels of a Prometheus series.
+type Labels map[string]string
+
+// Prometheus series which were aggregated into a datum, keyed by all of their labels. Only kept so a datum which
+// cannot be pushed can be traced back to where it came from.
+type sources map[string][]prompb.Label
+
+// Adds a series.
+func (s *sources) add(key string, labels []prompb.Label) {
+	if *s == nil {
+		*s = make(sources)
+	}
+
+	(*s)[key] = labels
+}
+
+// Labels of each series sorted by key, so they are deterministic.
+func (s sources) labels() []Labels {
+	if len(s) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	result := make([]Labels, len(keys))
+
+	for i, key := range keys {
+		result[i] = make(Labels, len(s[key]))
+
+		for _, label := range s[key] {
+			result[i][label.Name] = label.Value
+		}
+	}
+
+	return result
+}
+
+// Part of a batch between two indexes.
+func (b Batch) slice(start, end int) Batch {
+	part := Batch{
+		Namespace: b.Namespace,
+		Data:      b.Data[start:end],
+	}
+
+	if len(b.Labels) == len(b.Data) {
+		part.Labels = b.Labels[start:end]
+	}
+
+	return part
+}
+
+// Joins two batches for the same namespace.
+func (b Batch) join(other Batch) Batch {
+	joined := Batch{
+		Namespace: b.Namespace,
+		Data:      append(append([]*cloudwatch.MetricDatum{}, b.Data...), other.Data...),
+	}
+
+	if joined.Namespace == "" {
+		joined.Namespace = other.Namespace
+	}
+
+	// Labels are kept in the same order as the data, even when only one of the batches has them.
+	if len(b.Labels) > 0 || len(other.Labels) > 0 {
+		joined.Labels = append(b.labels(), other.labels()...)
+	}
+
+	return joined
+}
+
+// Labels of each datum in a batch, which are empty when the batch does not have them.
+func (b Batch) labels() [][]Labels {
+	if len(b.Labels) == len(b.Data) {
+		return b.Labels
+	}
+
+	return make([][]Labels, len(b.Data))
+}
+
+// DeadLetters for every datum in a batch.
+func (b Batch) DeadLetters(code string) []DeadLetterEntry {
+	entries := make([]DeadLetterEntry, len(b.Data))
+
+	for i, datum := range b.Data {
+		entries[i] = DeadLetterEntry{
+			Namespace: b.Namespace,
+			Datum:     datum,
+			Code:      code,
+		}
+
+		if len(b.Labels) == len(b.Data) {
+			entries[i].Labels = b.Labels[i]
+		}
+	}
+
+	return entries
+}
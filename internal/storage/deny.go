@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	denyMetrics    = "metrics"
+	denySelectors  = "selectors"
+	denyDimensions = "dimensions"
+)
+
+// Deny rules which take precedence over the whitelist.
+type Deny struct {
+	// Metrics which are dropped. Supports the same patterns and selectors as the whitelist.
+	Metrics []string `json:"metrics" yaml:"metrics"`
+	// Series which are dropped, matched by a selector eg. {namespace="kube-system"}.
+	Selectors []string `json:"selectors" yaml:"selectors"`
+	// Labels which are never used as dimensions. Supports the same patterns as the whitelist.
+	Dimensions []string `json:"dimensions" yaml:"dimensions"`
+}
+
+// Deny rules compiled from the configuration.
+type denylist struct {
+	series     []denyRule
+	selectors  *selectorSet
+	dimensions []denyRule
+}
+
+// Deny rule and the section of the configuration it was declared in, which are used to count the series it matches.
+type denyRule struct {
+	section string
+	value   string
+	pattern pattern
+}
+
+// Compiles the deny rules.
+func newDenylist(deny Deny) (*denylist, error) {
+	d := &denylist{}
+
+	var values []string
+
+	for _, section := range []struct {
+		name   string
+		values []string
+	}{
+		{denyMetrics, deny.Metrics},
+		{denySelectors, deny.Selectors},
+	} {
+		for _, value := range section.values {
+			d.series = append(d.series, denyRule{section: section.name, value: value})
+			values = append(values, value)
+		}
+	}
+
+	selectors, err := newSelectorSet(values)
+	if err != nil {
+		return nil, err
+	}
+
+	d.selectors = selectors
+
+	for _, value := range deny.Dimensions {
+		p, err := compilePattern(value)
+		if err != nil {
+			return nil, err
+		}
+
+		d.dimensions = append(d.dimensions, denyRule{section: denyDimensions, value: value, pattern: p})
+	}
+
+	return d, nil
+}
+
+// Reports whether a series is denied, counting the series against the first rule which matched. Rules are matched by the name
+// of the series and the name of the metric family it belongs to.
+func (d *denylist) deny(names []string, labels []prompb.Label) bool {
+	i, ok := d.selectors.match(names, labels)
+	if !ok {
+		return false
+	}
+
+	seriesDenied.WithLabelValues(d.series[i].section, d.series[i].value).Inc()
+
+	return true
+}
+
+// Returns an error when a rule denies a dimension of a metric with strict dimensions, which would otherwise be
+// published without a dimension it must have.
+func (d *denylist) strict(metric Metric) error {
+	if !metric.StrictDimensions {
+		return nil
+	}
+
+	for _, dimension := range metric.Dimensions {
+		if rule, ok := d.dimension(dimension); ok {
+			return fmt.Errorf("strict dimension of %s is denied by %s: %s", metric.Name, rule, dimension)
+		}
+	}
+
+	return nil
+}
+
+// Reports whether a label is denied as a dimension, returning the first rule which matched so the series can be
+// counted against it once.
+func (d *denylist) dimension(name string) (string, bool) {
+	for _, rule := range d.dimensions {
+		if rule.pattern.match(name) {
+			return rule.value, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// MaxDimensions which CloudWatch accepts for a single datum.
+const MaxDimensions = 10
+
+// Compiles the static dimensions, sorted by name so datums are deterministic.
+func staticDimensions(whitelist Whitelist) ([]*cloudwatch.Dimension, error) {
+	var dimensions []*cloudwatch.Dimension
+
+	for name, value := range whitelist.StaticDimensions {
+		if name == "" || value == "" {
+			return nil, errors.New("static dimensions require a name and value")
+		}
+
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String(name),
+			Value: aws.String(value),
+		})
+	}
+
+	names := make(map[string]bool)
+
+	for label, name := range whitelist.ExternalLabels {
+		if label == "" || name == "" {
+			return nil, errors.New("external labels require a label and dimension name")
+		}
+
+		if _, ok := whitelist.StaticDimensions[name]; ok || names[name] {
+			return nil, fmt.Errorf("dimension is declared more than once: %s", name)
+		}
+
+		names[name] = true
+	}
+
+	if len(dimensions)+len(whitelist.ExternalLabels) > MaxDimensions {
+		return nil, fmt.Errorf("static dimensions and external labels exceed the limit of %d dimensions", MaxDimensions)
+	}
+
+	sort.Slice(dimensions, func(i, j int) bool {
+		return *dimensions[i].Name < *dimensions[j].Name
+	})
+
+	return dimensions, nil
+}
+
+// Adds the static dimensions and the external labels of a series to its dimensions. These take precedence over the
+// dimensions of the series, which are dropped if they have the same name or would exceed the CloudWatch limit.
+func (c *Client) withStatic(dimensions []*cloudwatch.Dimension, labels []prompb.Label) []*cloudwatch.Dimension {
+	if len(c.static) == 0 && len(c.whitelist.ExternalLabels) == 0 {
+		return dimensions
+	}
+
+	result := make([]*cloudwatch.Dimension, 0, MaxDimensions)
+	result = append(result, c.static...)
+
+	var external []*cloudwatch.Dimension
+
+	for _, label := range labels {
+		if name, ok := c.whitelist.ExternalLabels[label.Name]; ok && label.Value != "" {
+			external = append(external, &cloudwatch.Dimension{
+				Name:  aws.String(name),
+				Value: aws.String(label.Value),
+			})
+		}
+	}
+
+	sort.Slice(external, func(i, j int) bool {
+		return *external[i].Name < *external[j].Name
+	})
+
+	result = append(result, external...)
+
+	for _, dimension := range dimensions {
+		if len(result) >= MaxDimensions {
+			break
+		}
+
+		if hasDimension(result, *dimension.Name) {
+			continue
+		}
+
+		result = append(result, dimension)
+	}
+
+	return result
+}
+
+// Reports whether a dimension with the given name is in a list.
+func hasDimension(dimensions []*cloudwatch.Dimension, name string) bool {
+	for _, dimension := range dimensions {
+		if *dimension.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+
+	mocklog "github.com/skpr/prometheus-cloudwatch/internal/storage/mock/log"
+	storageutils "github.com/skpr/prometheus-cloudwatch/internal/storage/utils"
+)
+
+func TestStaticDimensions(t *testing.T) {
+	client, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics:          []Metric{{Name: "metric1"}},
+		Labels:           []string{"*"},
+		StaticDimensions: map[string]string{"Cluster": "production"},
+		ExternalLabels:   map[string]string{"region": "Region"},
+	})
+	assert.Nil(t, err)
+
+	labels := []prompb.Label{
+		{Name: model.MetricNameLabel, Value: "metric1"},
+		{Name: "Cluster", Value: "other"},
+		{Name: "region", Value: "ap-southeast-2"},
+	}
+
+	for i := 0; i < MaxDimensions; i++ {
+		labels = append(labels, prompb.Label{Name: fmt.Sprintf("label%d", i), Value: "value"})
+	}
+
+	err = client.Add(prompb.TimeSeries{
+		Labels:  labels,
+		Samples: []prompb.Sample{{Value: 1, Timestamp: storageutils.Timestamp(time.Now())}},
+	})
+	assert.Nil(t, err)
+
+	batches := client.Flush()
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0].Data, 1)
+
+	// Static dimensions and external labels take precedence over the labels of the series.
+	dimensions := batches[0].Data[0].Dimensions
+	assert.Len(t, dimensions, MaxDimensions)
+	assert.Equal(t, &cloudwatch.Dimension{Name: aws.String("Cluster"), Value: aws.String("production")}, dimensions[0])
+	assert.Equal(t, &cloudwatch.Dimension{Name: aws.String("Region"), Value: aws.String("ap-southeast-2")}, dimensions[1])
+	assert.Equal(t, "region", *dimensions[2].Name)
+	assert.Equal(t, "label6", *dimensions[9].Name)
+}
+
+func TestStaticDimensionsOnly(t *testing.T) {
+	client, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics:          []Metric{{Name: "metric1"}},
+		Labels:           []string{"namespace"},
+		StaticDimensions: map[string]string{"Cluster": "production"},
+	})
+	assert.Nil(t, err)
+
+	// The series has no whitelisted labels, but is published with the static dimensions.
+	err = client.Add(prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: model.MetricNameLabel, Value: "metric1"}, {Name: "pod", Value: "web-1"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: storageutils.Timestamp(time.Now())}},
+	})
+	assert.Nil(t, err)
+
+	batches := client.Flush()
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0].Data, 1)
+	assert.Equal(t, []*cloudwatch.Dimension{
+		{Name: aws.String("Cluster"), Value: aws.String("production")},
+	}, batches[0].Data[0].Dimensions)
+}
+
+func TestStaticDimensionsInvalid(t *testing.T) {
+	static := make(map[string]string)
+	for i := 0; i <= MaxDimensions; i++ {
+		static[fmt.Sprintf("Dimension%d", i)] = "value"
+	}
+
+	for _, whitelist := range []Whitelist{
+		{StaticDimensions: map[string]string{"Cluster": ""}},
+		{StaticDimensions: map[string]string{"Cluster": "production"}, ExternalLabels: map[string]string{"cluster": "Cluster"}},
+		{StaticDimensions: static},
+	} {
+		whitelist.Metrics = []Metric{{Name: "metric1"}}
+		whitelist.Labels = []string{"foo"}
+
+		_, err := New(mocklog.New(), "test", 10, whitelist)
+		assert.Error(t, err)
+	}
+}
+
+func TestAllowNoDimensions(t *testing.T) {
+	now := storageutils.Timestamp(time.Now())
+
+	// The labels whitelist is optional.
+	client, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics: []Metric{
+			{Name: "cluster_autoscaler_nodes_count", AllowNoDimensions: true},
+			{Name: "metric1"},
+		},
+	})
+	assert.Nil(t, err)
+
+	for _, name := range []string{"cluster_autoscaler_nodes_count", "metric1"} {
+		err = client.Add(prompb.TimeSeries{
+			Labels: []prompb.Label{
+				{Name: model.MetricNameLabel, Value: name},
+				{Name: "instance", Value: "localhost"},
+			},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: now}},
+		})
+		assert.Nil(t, err)
+	}
+
+	batches := client.Flush()
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0].Data, 1)
+	assert.Equal(t, "cluster_autoscaler_nodes_count", *batches[0].Data[0].MetricName)
+	assert.Empty(t, batches[0].Data[0].Dimensions)
+
+	// Allowed for every metric.
+	client, err = New(mocklog.New(), "test", 10, Whitelist{
+		Metrics:           []Metric{{Name: "metric1"}},
+		AllowNoDimensions: true,
+	})
+	assert.Nil(t, err)
+
+	err = client.Add(prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: model.MetricNameLabel, Value: "metric1"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: now}},
+	})
+	assert.Nil(t, err)
+
+	batches = client.Flush()
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0].Data, 1)
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// ErrorCodeUnknown is used for errors which did not come from CloudWatch.
+const ErrorCodeUnknown = "Unknown"
+
+// SendError is returned when a batch could not be pushed in full.
+type SendError struct {
+	Err error
+	// Datums which were not pushed. Datums which CloudWatch rejected have already been sent to the dead-letter sink,
+	// so they are not included.
+	Batch Batch
+}
+
+// Error message for the SendError.
+func (e *SendError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwraps the error returned by CloudWatch.
+func cause(err error) error {
+	if serr, ok := err.(*SendError); ok {
+		return serr.Err
+	}
+
+	return err
+}
+
+// ErrorCode returned by CloudWatch for a failed request.
+func ErrorCode(err error) string {
+	if aerr, ok := cause(err).(awserr.Error); ok {
+		return aerr.Code()
+	}
+
+	return ErrorCodeUnknown
+}
+
+// Throttled reports whether CloudWatch rejected a request because of rate limiting.
+func Throttled(err error) bool {
+	return request.IsErrorThrottle(cause(err))
+}
+
+// Retryable reports whether a request which failed could succeed if it were sent again.
+// Throttling, server side failures and network errors are retryable. Validation errors are not.
+func Retryable(err error) bool {
+	err = cause(err)
+
+	if err == nil {
+		return false
+	}
+
+	if request.IsErrorThrottle(err) || request.IsErrorRetryable(err) {
+		return true
+	}
+
+	if rerr, ok := err.(awserr.RequestFailure); ok {
+		return rerr.StatusCode() >= 500
+	}
+
+	// Errors which did not come from CloudWatch are most likely network failures.
+	_, ok := err.(awserr.Error)
+
+	return !ok
+}
+
+// Rejected reports whether CloudWatch rejected a request because of an invalid parameter, which is most likely caused
+// by one of the datums in the request rather than all of them.
+func Rejected(err error) bool {
+	switch ErrorCode(err) {
+	case cloudwatch.ErrCodeInvalidParameterValueException, cloudwatch.ErrCodeInvalidParameterCombinationException, cloudwatch.ErrCodeMissingRequiredParameterException, request.InvalidParameterErrCode:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		code      string
+		retryable bool
+		throttled bool
+		rejected  bool
+	}{
+		{
+			err:       awserr.NewRequestFailure(awserr.New("Throttling", "Rate exceeded", nil), 400, "1"),
+			code:      "Throttling",
+			retryable: true,
+			throttled: true,
+		},
+		{
+			err:       awserr.NewRequestFailure(awserr.New(cloudwatch.ErrCodeInternalServiceFault, "Internal", nil), 500, "2"),
+			code:      cloudwatch.ErrCodeInternalServiceFault,
+			retryable: true,
+		},
+		{
+			err:      awserr.NewRequestFailure(awserr.New(cloudwatch.ErrCodeInvalidParameterValueException, "Invalid", nil), 400, "3"),
+			code:     cloudwatch.ErrCodeInvalidParameterValueException,
+			rejected: true,
+		},
+		{
+			err:       errors.New("connection reset by peer"),
+			code:      ErrorCodeUnknown,
+			retryable: true,
+		},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.code, ErrorCode(tt.err))
+		assert.Equal(t, tt.retryable, Retryable(tt.err), tt.code)
+		assert.Equal(t, tt.throttled, Throttled(tt.err), tt.code)
+		assert.Equal(t, tt.rejected, Rejected(tt.err), tt.code)
+	}
+}
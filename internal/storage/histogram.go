@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+
+	storageutils "github.com/skpr/prometheus-cloudwatch/internal/storage/utils"
+)
+
+// Increase of each bucket of a histogram within a single period.
+type histogram struct {
+	name       *string
+	dimensions []*cloudwatch.Dimension
+	timestamp  *time.Time
+	unit       string
+	resolution *int64
+	// Keyed by the upper bound of the bucket.
+	buckets map[float64]float64
+	sources sources
+}
+
+// Adds a series which belongs to a histogram family. Buckets are grouped by their other labels and converted to the
+// increase since the previous sample. The _sum and _count series are not needed because the buckets already describe
+// the distribution.
+func (c *Client) addHistogram(ts prompb.TimeSeries, rule Metric, suffix string, now time.Time) error {
+	if suffix != suffixBucket {
+		return nil
+	}
+
+	var (
+		bound  float64
+		found  bool
+		labels []prompb.Label
+	)
+
+	for _, label := range ts.Labels {
+		if label.Name != model.BucketLabel {
+			labels = append(labels, label)
+			continue
+		}
+
+		value, err := strconv.ParseFloat(label.Value, 64)
+		if err != nil {
+			break
+		}
+
+		bound, found = value, true
+	}
+
+	if !found {
+		c.logger.Infof("Skipping because bucket has an invalid upper bound: %s", rule.Name)
+		samplesDropped.WithLabelValues(reasonInvalid).Add(float64(len(ts.Samples)))
+		return nil
+	}
+
+	dimensions := c.withStatic(storageutils.Dimensions(labels, c.dimensions(rule, labels)), labels)
+	if len(dimensions) == 0 && !c.allowNoDimensions(rule) {
+		c.logger.Infof("Skipping because no dimensions were found: %s", rule.Name)
+		samplesDropped.WithLabelValues(reasonDimensions).Add(float64(len(ts.Samples)))
+		return nil
+	}
+
+	// Every bucket of a histogram is the same source once the bucket label has been removed.
+	var original []prompb.Label
+
+	for _, label := range rule.labels {
+		if label.Name != model.BucketLabel {
+			original = append(original, label)
+		}
+	}
+
+	var (
+		unit   = c.unit(rule.Name, rule)
+		source = storageutils.LabelsKey(original)
+	)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, sample := range c.convertCounter(ts, CounterDelta, now).Samples {
+		if math.IsNaN(sample.Value) {
+			samplesDropped.WithLabelValues(nanReason(sample.Value)).Inc()
+			continue
+		}
+
+		timestamp := storageutils.Time(sample.Timestamp).Truncate(rule.period())
+
+		if !accepted(timestamp, now, 1) {
+			continue
+		}
+
+		metric := &cloudwatch.MetricDatum{
+			MetricName: aws.String(unit.name),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(timestamp),
+		}
+
+		key := datumKey(rule.namespace, metric)
+
+		h, ok := c.histograms[key]
+		if !ok {
+			h = &histogram{
+				name:       metric.MetricName,
+				dimensions: metric.Dimensions,
+				timestamp:  metric.Timestamp,
+				unit:       unit.unit,
+				resolution: rule.storageResolution(),
+				buckets:    make(map[float64]float64),
+			}
+
+			c.histograms[key] = h
+		}
+
+		h.buckets[bound*unit.scale] += sample.Value
+		h.sources.add(source, original)
+	}
+
+	return nil
+}
+
+// Builds a Values/Counts distribution so CloudWatch can calculate percentiles. Each value is the upper bound of a
+// bucket and each count is the number of observations which fell within it. Observations in the +Inf bucket are
+// counted against the largest finite bound.
+func (h *histogram) datum() *cloudwatch.MetricDatum {
+	bounds := make([]float64, 0, len(h.buckets))
+	for bound := range h.buckets {
+		bounds = append(bounds, bound)
+	}
+
+	sort.Float64s(bounds)
+
+	metric := &cloudwatch.MetricDatum{
+		MetricName:        h.name,
+		Dimensions:        h.dimensions,
+		Timestamp:         h.timestamp,
+		Unit:              aws.String(h.unit),
+		StorageResolution: h.resolution,
+	}
+
+	var (
+		previous float64
+		largest  = math.NaN()
+	)
+
+	for _, bound := range bounds {
+		// Buckets are cumulative, so the observations within a bucket are the difference to the one before it.
+		count := h.buckets[bound] - previous
+		previous = h.buckets[bound]
+
+		value := bound
+
+		if math.IsInf(bound, 1) {
+			value = largest
+		} else {
+			largest = bound
+		}
+
+		if count <= 0 || math.IsNaN(value) {
+			continue
+		}
+
+		if n := len(metric.Values); n > 0 && *metric.Values[n-1] == value {
+			*metric.Counts[n-1] += count
+			continue
+		}
+
+		metric.Values = append(metric.Values, aws.Float64(value))
+		metric.Counts = append(metric.Counts, aws.Float64(count))
+	}
+
+	if len(metric.Values) == 0 {
+		return nil
+	}
+
+	return metric
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+
+	mocklog "github.com/skpr/prometheus-cloudwatch/internal/storage/mock/log"
+	storageutils "github.com/skpr/prometheus-cloudwatch/internal/storage/utils"
+)
+
+func TestHistogram(t *testing.T) {
+	client, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics: []Metric{{Name: "request_duration_seconds", Type: TypeHistogram}},
+		Labels:  []string{"foo"},
+	})
+	assert.Nil(t, err)
+
+	now := storageutils.Timestamp(client.(*Client).now().Truncate(StandardResolution))
+
+	bucket := func(le string, value float64, timestamp int64) prompb.TimeSeries {
+		return prompb.TimeSeries{
+			Labels: []prompb.Label{
+				{
+					Name:  model.MetricNameLabel,
+					Value: "request_duration_seconds_bucket",
+				},
+				{
+					Name:  "foo",
+					Value: "bar",
+				},
+				{
+					Name:  model.BucketLabel,
+					Value: le,
+				},
+			},
+			Samples: []prompb.Sample{
+				{
+					Value:     value,
+					Timestamp: timestamp,
+				},
+			},
+		}
+	}
+
+	series := []prompb.TimeSeries{
+		bucket("0.1", 1, now),
+		bucket("0.5", 3, now),
+		bucket("+Inf", 4, now),
+		bucket("0.1", 3, now+10000),
+		bucket("0.5", 6, now+10000),
+		bucket("+Inf", 8, now+10000),
+		{
+			Labels: []prompb.Label{
+				{
+					Name:  model.MetricNameLabel,
+					Value: "request_duration_seconds_count",
+				},
+				{
+					Name:  "foo",
+					Value: "bar",
+				},
+			},
+			Samples: []prompb.Sample{
+				{
+					Value:     8,
+					Timestamp: now + 10000,
+				},
+			},
+		},
+	}
+
+	for _, ts := range series {
+		assert.Nil(t, client.Add(ts))
+	}
+
+	batches := client.Flush()
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0].Data, 1)
+
+	// 2 observations <= 0.1, 1 observation <= 0.5 and 1 observation in +Inf which is counted against 0.5.
+	datum := batches[0].Data[0]
+	assert.Equal(t, "request_duration_seconds", *datum.MetricName)
+	assert.Equal(t, []*float64{aws.Float64(0.1), aws.Float64(0.5)}, datum.Values)
+	assert.Equal(t, []*float64{aws.Float64(2), aws.Float64(2)}, datum.Counts)
+}
@@ -3,4 +3,5 @@ package storage
 // Logger for printing out storage events.
 type Logger interface {
 	Infof(string, ...interface{})
+	Errorf(string, ...interface{})
 }
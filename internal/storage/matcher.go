@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Limits the number of names a matcher remembers, so a flood of unique names cannot grow memory without bound.
+const matcherCacheSize = 10000
+
+// Pattern which matches a metric or label name. Names are matched exactly unless they are a glob eg. node_* or an RE2
+// regular expression wrapped in slashes eg. /node_(cpu|memory)_.*/. Patterns must match the whole name.
+type pattern struct {
+	value  string
+	regexp *regexp.Regexp
+}
+
+// Compiles a pattern, returning an error if it is not a valid regular expression or glob.
+func compilePattern(value string) (pattern, error) {
+	p := pattern{value: value}
+
+	var expr string
+
+	switch {
+	case len(value) > 1 && strings.HasPrefix(value, "/") && strings.HasSuffix(value, "/"):
+		expr = value[1 : len(value)-1]
+	case strings.ContainsAny(value, "*?["):
+		glob, err := globToRegexp(value)
+		if err != nil {
+			return p, err
+		}
+
+		expr = glob
+	default:
+		return p, nil
+	}
+
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return p, fmt.Errorf("invalid pattern %s: %s", value, err)
+	}
+
+	p.regexp = re
+
+	return p, nil
+}
+
+// Reports whether the pattern is matched exactly rather than as a glob or regular expression.
+func (p pattern) literal() bool {
+	return p.regexp == nil
+}
+
+// Reports whether a name matches the pattern.
+func (p pattern) match(name string) bool {
+	if p.regexp == nil {
+		return p.value == name
+	}
+
+	return p.regexp.MatchString(name)
+}
+
+// Converts a glob to a regular expression. Supports * (any characters), ? (a single character) and [...] (a
+// character class, negated with ! or ^).
+func globToRegexp(glob string) (string, error) {
+	var expr strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("invalid pattern %s: unterminated character class", glob)
+			}
+
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return expr.String(), nil
+}
+
+// Matcher for a set of patterns. Literal names are looked up in a map and the result for every other name is cached,
+// so the patterns are only evaluated the first time a name is seen.
+type matcher struct {
+	exact    map[string]bool
+	patterns []pattern
+
+	mutex sync.RWMutex
+	cache map[string]bool
+}
+
+// Compiles a set of patterns into a matcher.
+func newMatcher(values []string) (*matcher, error) {
+	m := &matcher{
+		exact: make(map[string]bool),
+		cache: make(map[string]bool),
+	}
+
+	for _, value := range values {
+		p, err := compilePattern(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.literal() {
+			m.exact[value] = true
+			continue
+		}
+
+		m.patterns = append(m.patterns, p)
+	}
+
+	return m, nil
+}
+
+// Reports whether a name matches any of the patterns.
+func (m *matcher) match(name string) bool {
+	if m.exact[name] {
+		return true
+	}
+
+	if len(m.patterns) == 0 {
+		return false
+	}
+
+	m.mutex.RLock()
+	matched, ok := m.cache[name]
+	m.mutex.RUnlock()
+
+	if ok {
+		return matched
+	}
+
+	for _, p := range m.patterns {
+		if p.match(name) {
+			matched = true
+			break
+		}
+	}
+
+	m.mutex.Lock()
+	if len(m.cache) >= matcherCacheSize {
+		m.cache = make(map[string]bool)
+	}
+	m.cache[name] = matched
+	m.mutex.Unlock()
+
+	return matched
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatcher(t *testing.T) {
+	m, err := newMatcher([]string{"namespace", "kubernetes_*", "/(pod|container)_name/", "zone_[ab]", "region_?"})
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"namespace", true},
+		{"namespace_id", false},
+		{"kubernetes_namespace", true},
+		{"pod_name", true},
+		{"container_name", true},
+		{"my_pod_name", false},
+		{"zone_a", true},
+		{"zone_c", false},
+		{"region_1", true},
+		{"region_10", false},
+		{"instance", false},
+	}
+
+	for _, test := range tests {
+		// Evaluated twice so the cached result is also checked.
+		assert.Equal(t, test.want, m.match(test.name), test.name)
+		assert.Equal(t, test.want, m.match(test.name), test.name)
+	}
+}
+
+func TestMatcherInvalid(t *testing.T) {
+	for _, value := range []string{"/node_(cpu/", "zone_[ab"} {
+		_, err := newMatcher([]string{value})
+		assert.Error(t, err, value)
+	}
+}
+
+func TestRules(t *testing.T) {
+	r, err := newRules([]Metric{
+		{Name: "node_load1", Counter: CounterDelta},
+		{Name: "node_*"},
+		{Name: "/http_.*_seconds/", Type: TypeHistogram},
+	})
+	assert.Nil(t, err)
+
+	rule, suffix, ok := r.metric("node_load1", nil)
+	assert.True(t, ok)
+	assert.Equal(t, "", suffix)
+	assert.Equal(t, CounterDelta, rule.Counter)
+
+	rule, _, ok = r.metric("node_load5", nil)
+	assert.True(t, ok)
+	assert.Equal(t, "node_*", rule.Name)
+
+	rule, suffix, ok = r.metric("http_request_duration_seconds_bucket", nil)
+	assert.True(t, ok)
+	assert.Equal(t, suffixBucket, suffix)
+	assert.Equal(t, TypeHistogram, rule.Type)
+
+	_, _, ok = r.metric("http_request_duration_seconds", nil)
+	assert.False(t, ok)
+
+	_, _, ok = r.metric("process_cpu_seconds_total", nil)
+	assert.False(t, ok)
+}
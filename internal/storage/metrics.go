@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Namespace used for metrics describing this writer.
+	metricsNamespace = "prometheus_cloudwatch"
+
+	reasonInvalid = "invalid"
+	reasonNaN     = "nan"
+	// Prometheus marks a series which has disappeared with a special NaN value.
+	reasonStale      = "stale"
+	reasonWhitelist  = "whitelist"
+	reasonDeny       = "deny"
+	reasonRelabel    = "relabel"
+	reasonNamespace  = "namespace"
+	reasonDimensions = "dimensions"
+	reasonTooOld     = "too_old"
+	reasonTooNew     = "too_new"
+	// The first sample of a counter is only used as the starting point for a rate or delta.
+	reasonCounterFirst = "counter_first"
+	reasonOutOfOrder   = "out_of_order"
+)
+
+var (
+	samplesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "samples_received_total",
+		Help:      "Number of samples received from Prometheus.",
+	})
+
+	samplesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "samples_dropped_total",
+		Help:      "Number of samples which were not pushed to CloudWatch, by reason.",
+	}, []string{"reason"})
+
+	seriesDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "series_denied_total",
+		Help:      "Number of series dropped by a deny rule, by section and rule.",
+	}, []string{"section", "rule"})
+
+	dimensionsDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "series_dimensions_denied_total",
+		Help:      "Number of series which were pushed without a dimension because it matched a deny rule, by rule.",
+	}, []string{"rule"})
+
+	seriesCollisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "series_collisions_total",
+		Help:      "Number of series which collapsed into the same datum as another series once labels were dropped, by the collision policy which resolved them.",
+	}, []string{"policy"})
+
+	counterResets = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "counter_resets_total",
+		Help:      "Number of counter resets detected while converting counters to rates or deltas.",
+	})
+
+	datumsPushed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "datums_pushed_total",
+		Help:      "Number of datums pushed to CloudWatch, by storage resolution in seconds.",
+	}, []string{"resolution"})
+
+	highResolutionMetrics = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "high_resolution_metrics",
+		Help:      "Number of distinct high resolution metrics in the last flush. High resolution alarms are charged at a higher rate.",
+	})
+
+	datumsInvalid = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "datums_invalid_total",
+		Help:      "Number of times a datum broke a CloudWatch limit, by validation rule and the action which was taken.",
+	}, []string{"rule", "action"})
+
+	datumsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "datums_failed_total",
+		Help:      "Number of datums which CloudWatch failed to accept.",
+	})
+
+	batchRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "batch_retries_total",
+		Help:      "Number of times a batch was retried after CloudWatch failed it with a retryable error, by error code.",
+	}, []string{"code"})
+
+	batchesGivenUp = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "batches_given_up_total",
+		Help:      "Number of batches which used up their retry budget or maximum elapsed time, by error code.",
+	}, []string{"code"})
+
+	batchesBisected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "batches_bisected_total",
+		Help:      "Number of times a batch was split in half to find the datums CloudWatch rejected, by error code.",
+	}, []string{"code"})
+
+	datumsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "datums_rejected_total",
+		Help:      "Number of datums which CloudWatch rejected permanently, by error code.",
+	}, []string{"code"})
+)
+
+func init() {
+	prometheus.MustRegister(samplesReceived, samplesDropped, seriesDenied, dimensionsDenied, seriesCollisions, counterResets, datumsPushed, highResolutionMetrics, datumsInvalid, datumsFailed, batchRetries, batchesGivenUp, batchesBisected, datumsRejected)
+}
@@ -1,6 +1,8 @@
 package cloudwatch
 
 import (
+	"sync"
+
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
 )
@@ -8,6 +10,17 @@ import (
 // Client which mocks the CloudFront client.
 type Client struct {
 	cloudwatchiface.CloudWatchAPI
+
+	mutex  sync.Mutex
+	Inputs []*cloudwatch.PutMetricDataInput
+	// Errs are returned in turn instead of storing the input, before falling back to Err.
+	Errs []error
+	// Err is returned instead of storing the input when set.
+	Err error
+	// Validate is called for each input which would otherwise be stored, which is rejected when it returns an error.
+	Validate func(*cloudwatch.PutMetricDataInput) error
+	// Calls which have been made, including those which returned an error.
+	Calls int
 }
 
 // New mock CloudFront client.
@@ -17,6 +30,28 @@ func New() *Client {
 
 // PutMetricData mock implementation.
 func (c *Client) PutMetricData(input *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
-	// @todo, Add persistence if required by tests.
-	return nil, nil
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.Calls++
+
+	if len(c.Errs) > 0 {
+		err := c.Errs[0]
+		c.Errs = c.Errs[1:]
+		return nil, err
+	}
+
+	if c.Err != nil {
+		return nil, c.Err
+	}
+
+	if c.Validate != nil {
+		if err := c.Validate(input); err != nil {
+			return nil, err
+		}
+	}
+
+	c.Inputs = append(c.Inputs, input)
+
+	return &cloudwatch.PutMetricDataOutput{}, nil
 }
@@ -1,9 +1,13 @@
 package log
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+)
 
 // Logger for testing the storage package.
 type Logger struct {
+	mutex    sync.Mutex
 	Messages []string
 }
 
@@ -14,5 +18,16 @@ func New() *Logger {
 
 // Infof mock implementation.
 func (l *Logger) Infof(format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.Messages = append(l.Messages, fmt.Sprintf(format, args...))
+}
+
+// Errorf mock implementation.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
 	l.Messages = append(l.Messages, fmt.Sprintf(format, args...))
 }
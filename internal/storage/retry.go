@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryParams for retrying batches which CloudWatch failed with a retryable error.
+type RetryParams struct {
+	// Number of times a batch is retried before it is given up on. Batches are not retried when 0.
+	MaxRetries int
+	// Delay before the first retry, which doubles with every retry after it.
+	BaseDelay time.Duration
+	// Longest delay between retries.
+	MaxDelay time.Duration
+	// Longest time spent pushing a batch, including retries. Unlimited when 0.
+	MaxElapsed time.Duration
+}
+
+// Retries which have been made for a batch, shared by every request made to push it.
+type retryState struct {
+	start   time.Time
+	retries int
+}
+
+// Validate the retry params.
+func (p RetryParams) Validate() error {
+	if p.MaxRetries < 0 {
+		return errors.New("max retries must not be negative")
+	}
+
+	if p.MaxRetries > 0 && p.BaseDelay <= 0 {
+		return errors.New("base delay must be greater than 0")
+	}
+
+	if p.MaxDelay < p.BaseDelay {
+		return errors.New("max delay must not be less than the base delay")
+	}
+
+	if p.MaxElapsed < 0 {
+		return errors.New("max elapsed must not be negative")
+	}
+
+	return nil
+}
+
+// Delay before a retry using exponential backoff with full jitter, so workers which failed at the same time do not
+// retry at the same time.
+func (p RetryParams) delay(attempt int) time.Duration {
+	ceiling := p.MaxDelay
+
+	// Stops doubling once the ceiling has been reached, so the delay cannot overflow.
+	if attempt < 32 {
+		if backoff := p.BaseDelay << uint(attempt); backoff > 0 && backoff < ceiling {
+			ceiling = backoff
+		}
+	}
+
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
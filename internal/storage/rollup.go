@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/prometheus/prompb"
+
+	storageutils "github.com/skpr/prometheus-cloudwatch/internal/storage/utils"
+)
+
+const (
+	// RollupSum adds the values of every series in a group.
+	RollupSum = "sum"
+	// RollupAvg averages the values of every series in a group.
+	RollupAvg = "avg"
+	// RollupMin takes the lowest value of any series in a group.
+	RollupMin = "min"
+	// RollupMax takes the highest value of any series in a group.
+	RollupMax = "max"
+	// RollupCount counts the series in a group.
+	RollupCount = "count"
+)
+
+// Rollup which publishes a metric aggregated across the series which share a subset of its dimensions, the same as
+// aggregation_dimensions of the CloudWatch agent.
+type Rollup struct {
+	// Dimensions which series are grouped by. Series are aggregated into a single datum when empty.
+	Dimensions []string `json:"dimensions" yaml:"dimensions"`
+	// How the series in a group are combined eg. "sum".
+	Aggregation string `json:"aggregation" yaml:"aggregation"`
+}
+
+// Validate the configuration for a rollup.
+func (r Rollup) Validate() error {
+	switch r.Aggregation {
+	case RollupSum, RollupAvg, RollupMin, RollupMax, RollupCount:
+	default:
+		return fmt.Errorf("rollup aggregation not supported: %s", r.Aggregation)
+	}
+
+	for _, dimension := range r.Dimensions {
+		if p, err := compilePattern(dimension); err != nil || !p.literal() {
+			return fmt.Errorf("rollup dimensions must be label names: %s", dimension)
+		}
+	}
+
+	return nil
+}
+
+// Series which have been grouped for a rollup within a single period.
+type rollup struct {
+	series
+	aggregation string
+	// The samples of a delta counter are summed to get the value of a series, otherwise they are averaged.
+	delta   bool
+	members map[string][]float64
+}
+
+// Adds the samples of a series to each rollup of its rule. Series which are missing any of the dimensions of a rollup
+// are left out of it. Must be called with the mutex held.
+func (c *Client) addRollups(ts prompb.TimeSeries, rule Metric, unit metricUnit, metrics []*cloudwatch.MetricDatum) {
+	if len(rule.Rollups) == 0 {
+		return
+	}
+
+	member := storageutils.LabelsKey(ts.Labels)
+
+	for i, r := range rule.Rollups {
+		dimensions, ok := rollupDimensions(r, ts.Labels)
+		if !ok {
+			continue
+		}
+
+		dimensions = c.withStatic(dimensions, ts.Labels)
+
+		for _, metric := range metrics {
+			datum := &cloudwatch.MetricDatum{
+				MetricName: aws.String(unit.name),
+				Dimensions: dimensions,
+				Timestamp:  metric.Timestamp,
+			}
+
+			// Rollups are keyed separately so they cannot be merged with a series which has the same dimensions.
+			key := fmt.Sprintf("%s#%d", datumKey(rule.namespace, datum), i)
+
+			g, ok := c.rollups[key]
+			if !ok {
+				g = &rollup{
+					series: series{
+						name:       datum.MetricName,
+						dimensions: datum.Dimensions,
+						timestamp:  datum.Timestamp,
+						unit:       unit.unit,
+						resolution: rule.storageResolution(),
+					},
+					aggregation: r.Aggregation,
+					delta:       rule.Counter == CounterDelta,
+					members:     make(map[string][]float64),
+				}
+
+				c.rollups[key] = g
+			}
+
+			for _, value := range metric.Values {
+				g.members[member] = append(g.members[member], *value*unit.scale)
+			}
+		}
+	}
+}
+
+// Dimensions of a series for a rollup, or false if the series is missing any of them.
+func rollupDimensions(r Rollup, labels []prompb.Label) ([]*cloudwatch.Dimension, bool) {
+	var dimensions []*cloudwatch.Dimension
+
+	for _, name := range r.Dimensions {
+		value := labelValue(labels, name)
+		if value == "" {
+			return nil, false
+		}
+
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String(name),
+			Value: aws.String(value),
+		})
+	}
+
+	sort.Slice(dimensions, func(i, j int) bool {
+		return strings.Compare(*dimensions[i].Name, *dimensions[j].Name) < 0
+	})
+
+	return dimensions, true
+}
+
+// Series with the single value of the group.
+func (r *rollup) aggregate() *series {
+	s := r.series
+	s.values = []float64{combine(r.members, r.delta, r.aggregation)}
+
+	if r.aggregation == RollupCount {
+		s.unit = cloudwatch.StandardUnitCount
+	}
+
+	return &s
+}
+
+// Combines the samples of several series into a single value. The samples of each series are summed for delta
+// counters, otherwise they are averaged, before the series are combined with the aggregation.
+func combine(members map[string][]float64, delta bool, aggregation string) float64 {
+	var (
+		values = make([]float64, 0, len(members))
+		result float64
+	)
+
+	for _, samples := range members {
+		var sum float64
+
+		for _, sample := range samples {
+			sum += sample
+		}
+
+		if !delta {
+			sum /= float64(len(samples))
+		}
+
+		values = append(values, sum)
+	}
+
+	switch aggregation {
+	case RollupCount:
+		result = float64(len(values))
+	case RollupMin:
+		result = math.Inf(1)
+		for _, value := range values {
+			result = math.Min(result, value)
+		}
+	case RollupMax:
+		result = math.Inf(-1)
+		for _, value := range values {
+			result = math.Max(result, value)
+		}
+	default:
+		for _, value := range values {
+			result += value
+		}
+
+		if aggregation == RollupAvg {
+			result /= float64(len(values))
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+
+	mocklog "github.com/skpr/prometheus-cloudwatch/internal/storage/mock/log"
+	storageutils "github.com/skpr/prometheus-cloudwatch/internal/storage/utils"
+)
+
+func TestRollup(t *testing.T) {
+	now := time.Now()
+
+	client, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics: []Metric{
+			{
+				Name: "queue_depth",
+				Rollups: []Rollup{
+					{Dimensions: []string{"namespace"}, Aggregation: RollupSum},
+					{Aggregation: RollupMax},
+					{Aggregation: RollupCount},
+				},
+			},
+		},
+		Labels: []string{"pod"},
+	})
+	assert.Nil(t, err)
+
+	for _, series := range []struct {
+		namespace string
+		pod       string
+		values    []float64
+	}{
+		{"default", "web-1", []float64{1, 3}},
+		{"default", "web-2", []float64{4}},
+		{"other", "web-3", []float64{10}},
+	} {
+		var samples []prompb.Sample
+
+		for _, value := range series.values {
+			samples = append(samples, prompb.Sample{Value: value, Timestamp: storageutils.Timestamp(now)})
+		}
+
+		err = client.Add(prompb.TimeSeries{
+			Labels: []prompb.Label{
+				{Name: model.MetricNameLabel, Value: "queue_depth"},
+				{Name: "namespace", Value: series.namespace},
+				{Name: "pod", Value: series.pod},
+			},
+			Samples: samples,
+		})
+		assert.Nil(t, err)
+	}
+
+	batches := client.Flush()
+	assert.Len(t, batches, 1)
+
+	rollups := make(map[string][]*float64)
+
+	for _, datum := range batches[0].Data {
+		if len(datum.Dimensions) == 1 && *datum.Dimensions[0].Name == "pod" {
+			continue
+		}
+
+		key := ""
+		if len(datum.Dimensions) > 0 {
+			key = *datum.Dimensions[0].Value
+		}
+
+		if datum.Unit != nil && *datum.Unit == cloudwatch.StandardUnitCount {
+			key = "count"
+		}
+
+		rollups[key] = datum.Values
+	}
+
+	// The samples of each series are averaged before the series are combined.
+	assert.Equal(t, map[string][]*float64{
+		"default": {aws.Float64(6)},
+		"other":   {aws.Float64(10)},
+		"":        {aws.Float64(10)},
+		"count":   {aws.Float64(3)},
+	}, rollups)
+}
+
+func TestRollupValidate(t *testing.T) {
+	assert.Nil(t, Rollup{Dimensions: []string{"namespace"}, Aggregation: RollupAvg}.Validate())
+	assert.Error(t, Rollup{Dimensions: []string{"namespace"}, Aggregation: "median"}.Validate())
+	assert.Error(t, Rollup{Dimensions: []string{"kubernetes_*"}, Aggregation: RollupSum}.Validate())
+	assert.Error(t, Metric{Name: "metric1", Type: TypeHistogram, Rollups: []Rollup{{Aggregation: RollupSum}}}.Validate())
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	// SourceLabel which is added to every series received from a remote write source eg. /write?source=cluster-a.
+	// Labels with the __ prefix are reserved, so it is never used as a dimension.
+	SourceLabel = "__source__"
+
+	// Maximum length of a CloudWatch namespace.
+	maxNamespaceLength = 255
+)
+
+// Route which pushes series to a namespace other than the default.
+type Route struct {
+	// Series which are routed, matched by a pattern or selector the same as the whitelist. Matches every series when
+	// empty.
+	Match string `json:"match" yaml:"match"`
+	// Remote write source which is routed. Matches every source when empty.
+	Source string `json:"source" yaml:"source"`
+	// Namespace the series are pushed to. Can be a template of the labels of the series eg. Custom/{{ .job }}.
+	Namespace string `json:"namespace" yaml:"namespace"`
+}
+
+// Routes compiled from the configuration, which are matched in the order they were declared.
+type router struct {
+	fallback  string
+	routes    []Route
+	selectors *selectorSet
+	templates []*template.Template
+}
+
+// Compiles the routes.
+func newRouter(fallback string, routes []Route) (*router, error) {
+	r := &router{
+		fallback: fallback,
+		routes:   routes,
+	}
+
+	var values []string
+
+	for _, route := range routes {
+		values = append(values, route.Match)
+
+		if route.Namespace == "" {
+			return nil, fmt.Errorf("route namespace was not provided: %s", route.Match)
+		}
+
+		var tmpl *template.Template
+
+		if strings.Contains(route.Namespace, "{{") {
+			t, err := template.New("namespace").Option("missingkey=zero").Parse(route.Namespace)
+			if err != nil {
+				return nil, fmt.Errorf("invalid namespace template %s: %s", route.Namespace, err)
+			}
+
+			tmpl = t
+		} else if err := validateNamespace(route.Namespace); err != nil {
+			return nil, err
+		}
+
+		r.templates = append(r.templates, tmpl)
+	}
+
+	selectors, err := newSelectorSet(values)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, route := range routes {
+		if route.Source != "" {
+			selectors.selectors[i].matchers = append(selectors.selectors[i].matchers, labelMatcher{
+				name:  SourceLabel,
+				op:    matchEqual,
+				value: route.Source,
+			})
+		}
+	}
+
+	r.selectors = selectors
+
+	return r, nil
+}
+
+// Namespace a series is pushed to. Returns an error if a template renders an invalid namespace.
+func (r *router) namespace(names []string, labels []prompb.Label) (string, error) {
+	i, ok := r.selectors.match(names, labels)
+	if !ok {
+		return r.fallback, nil
+	}
+
+	if r.templates[i] == nil {
+		return r.routes[i].Namespace, nil
+	}
+
+	data := make(map[string]string, len(labels))
+
+	for _, label := range labels {
+		data[label.Name] = label.Value
+	}
+
+	var namespace bytes.Buffer
+
+	if err := r.templates[i].Execute(&namespace, data); err != nil {
+		return "", err
+	}
+
+	if err := validateNamespace(namespace.String()); err != nil {
+		return "", err
+	}
+
+	return namespace.String(), nil
+}
+
+// Validates a namespace against the rules CloudWatch applies.
+func validateNamespace(namespace string) error {
+	if namespace == "" {
+		return fmt.Errorf("namespace is empty")
+	}
+
+	if len(namespace) > maxNamespaceLength {
+		return fmt.Errorf("namespace is longer than %d characters: %s", maxNamespaceLength, namespace)
+	}
+
+	if strings.HasPrefix(namespace, "AWS/") {
+		return fmt.Errorf("namespace cannot start with AWS/: %s", namespace)
+	}
+
+	for _, r := range namespace {
+		if r < 0x20 || r > 0x7e {
+			return fmt.Errorf("namespace must be printable ASCII: %s", namespace)
+		}
+	}
+
+	return nil
+}
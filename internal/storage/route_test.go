@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+
+	mocklog "github.com/skpr/prometheus-cloudwatch/internal/storage/mock/log"
+	storageutils "github.com/skpr/prometheus-cloudwatch/internal/storage/utils"
+)
+
+func TestRouter(t *testing.T) {
+	r, err := newRouter("Prometheus", []Route{
+		{Match: "node_*", Namespace: "Custom/Node"},
+		{Source: "cluster-a", Namespace: "Custom/ClusterA"},
+		{Match: `{job=~".+"}`, Namespace: "Custom/{{ .job }}"},
+	})
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name   string
+		labels []prompb.Label
+		want   string
+	}{
+		{"node_load1", []prompb.Label{{Name: "job", Value: "node"}}, "Custom/Node"},
+		{"up", []prompb.Label{{Name: SourceLabel, Value: "cluster-a"}, {Name: "job", Value: "api"}}, "Custom/ClusterA"},
+		{"up", []prompb.Label{{Name: "job", Value: "api"}}, "Custom/api"},
+		{"up", nil, "Prometheus"},
+	}
+
+	for _, test := range tests {
+		namespace, err := r.namespace([]string{test.name}, test.labels)
+		assert.Nil(t, err)
+		assert.Equal(t, test.want, namespace)
+	}
+
+	// Templates which render an invalid namespace are rejected.
+	_, err = r.namespace([]string{"up"}, []prompb.Label{{Name: "job", Value: "ünicode"}})
+	assert.Error(t, err)
+}
+
+func TestRouterOrder(t *testing.T) {
+	r, err := newRouter("Prometheus", []Route{
+		{Match: "lat", Namespace: "First"},
+		{Match: "lat_bucket", Namespace: "Second"},
+	})
+	assert.Nil(t, err)
+
+	// The first route which was declared wins, even when a later route matches the series name rather than the name
+	// of the family.
+	namespace, err := r.namespace([]string{"lat_bucket", "lat"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "First", namespace)
+
+	namespace, err = r.namespace([]string{"lat_sum", "lat"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "First", namespace)
+}
+
+func TestRouterInvalid(t *testing.T) {
+	for _, route := range []Route{
+		{Match: "node_*"},
+		{Namespace: "AWS/EC2"},
+		{Namespace: "Custom/{{ .job "},
+		{Match: "node_{", Namespace: "Custom/Node"},
+	} {
+		_, err := newRouter("Prometheus", []Route{route})
+		assert.Error(t, err)
+	}
+}
+
+func TestStorageNamespaces(t *testing.T) {
+	now := storageutils.Timestamp(time.Now())
+
+	client, err := New(mocklog.New(), "Prometheus", 10, Whitelist{
+		Metrics:    []Metric{{Name: "*"}},
+		Labels:     []string{"job"},
+		Namespaces: []Route{{Namespace: "Custom/{{ .team }}", Match: `{team!=""}`}},
+	})
+	assert.Nil(t, err)
+
+	for _, labels := range [][]prompb.Label{
+		{{Name: model.MetricNameLabel, Value: "metric1"}, {Name: "job", Value: "web"}, {Name: "team", Value: "a"}},
+		{{Name: model.MetricNameLabel, Value: "metric1"}, {Name: "job", Value: "web"}, {Name: "team", Value: "b"}},
+		{{Name: model.MetricNameLabel, Value: "metric1"}, {Name: "job", Value: "web"}, {Name: SourceLabel, Value: "cluster-a"}},
+	} {
+		err = client.Add(prompb.TimeSeries{
+			Labels:  labels,
+			Samples: []prompb.Sample{{Value: 1, Timestamp: now}},
+		})
+		assert.Nil(t, err)
+	}
+
+	// Series which only differ by namespace are not merged and each namespace is pushed in its own batch.
+	batches := client.Flush()
+	assert.Len(t, batches, 3)
+
+	for i, want := range []string{"Custom/a", "Custom/b", "Prometheus"} {
+		assert.Equal(t, want, batches[i].Namespace)
+		assert.Len(t, batches[i].Data, 1)
+		assert.Len(t, batches[i].Data[0].Dimensions, 1)
+	}
+}
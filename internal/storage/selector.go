@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	matchEqual     = "="
+	matchNotEqual  = "!="
+	matchRegexp    = "=~"
+	matchNotRegexp = "!~"
+)
+
+// Selector which matches a series by metric name and label values, using the same syntax as Prometheus
+// eg. http_requests_total{namespace=~"prod-.*",code!="200"}.
+type selector struct {
+	// Metric name pattern. Matches every metric when empty.
+	name     string
+	matchers []labelMatcher
+}
+
+// Set of selectors which are matched in the order they were declared. The selectors which could match a name are
+// cached, so the name patterns are only evaluated the first time a name is seen.
+type selectorSet struct {
+	selectors []selector
+	patterns  []pattern
+
+	mutex sync.RWMutex
+	cache map[string][]int
+}
+
+// Matcher for the value of a single label. Labels which are not present are treated as empty, the same as Prometheus.
+type labelMatcher struct {
+	name   string
+	op     string
+	value  string
+	regexp *regexp.Regexp
+}
+
+// Parses a selector. The metric name and the label matchers are both optional, but one must be provided.
+func parseSelector(value string) (selector, error) {
+	var s selector
+
+	start := strings.IndexByte(value, '{')
+
+	// A regular expression name can contain braces of its own eg. /node_.{4}/.
+	if strings.HasPrefix(value, "/") {
+		start = strings.Index(value[1:], "/{")
+		if start >= 0 {
+			start += 2
+		}
+	}
+
+	if start < 0 {
+		s.name = strings.TrimSpace(value)
+		return s, nil
+	}
+
+	if !strings.HasSuffix(strings.TrimSpace(value), "}") {
+		return s, fmt.Errorf("invalid selector %s: missing closing brace", value)
+	}
+
+	s.name = strings.TrimSpace(value[:start])
+
+	body := strings.TrimSpace(value[start+1 : strings.LastIndexByte(value, '}')])
+
+	for body != "" {
+		matcher, rest, err := parseLabelMatcher(body)
+		if err != nil {
+			return s, fmt.Errorf("invalid selector %s: %s", value, err)
+		}
+
+		s.matchers = append(s.matchers, matcher)
+
+		body = strings.TrimSpace(rest)
+		if body == "" {
+			break
+		}
+
+		if body[0] != ',' {
+			return s, fmt.Errorf("invalid selector %s: expected comma", value)
+		}
+
+		body = strings.TrimSpace(body[1:])
+	}
+
+	if s.name == "" && len(s.matchers) == 0 {
+		return s, fmt.Errorf("invalid selector %s: metric name or label matcher was not provided", value)
+	}
+
+	return s, nil
+}
+
+// Parses a single label matcher from the start of a string, returning what is left.
+func parseLabelMatcher(body string) (labelMatcher, string, error) {
+	var m labelMatcher
+
+	end := strings.IndexAny(body, "=!")
+	if end <= 0 {
+		return m, body, fmt.Errorf("expected label name")
+	}
+
+	m.name = strings.TrimSpace(body[:end])
+	body = body[end:]
+
+	for _, op := range []string{matchRegexp, matchNotRegexp, matchNotEqual, matchEqual} {
+		if strings.HasPrefix(body, op) {
+			m.op = op
+			break
+		}
+	}
+
+	if m.op == "" {
+		return m, body, fmt.Errorf("expected matcher for label %s", m.name)
+	}
+
+	body = strings.TrimSpace(body[len(m.op):])
+
+	value, rest, err := parseQuoted(body)
+	if err != nil {
+		return m, body, fmt.Errorf("label %s: %s", m.name, err)
+	}
+
+	m.value = value
+
+	if m.op == matchRegexp || m.op == matchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return m, body, fmt.Errorf("label %s: %s", m.name, err)
+		}
+
+		m.regexp = re
+	}
+
+	return m, rest, nil
+}
+
+// Parses a double quoted or backtick quoted string from the start of a string, returning what is left.
+func parseQuoted(body string) (string, string, error) {
+	if body == "" || (body[0] != '"' && body[0] != '`') {
+		return "", body, fmt.Errorf("expected quoted value")
+	}
+
+	quote := body[0]
+
+	for i := 1; i < len(body); i++ {
+		if body[i] == '\\' && quote == '"' {
+			i++
+			continue
+		}
+
+		if body[i] != quote {
+			continue
+		}
+
+		value, err := strconv.Unquote(body[:i+1])
+		if err != nil {
+			return "", body, fmt.Errorf("invalid quoted value %s", body[:i+1])
+		}
+
+		return value, body[i+1:], nil
+	}
+
+	return "", body, fmt.Errorf("unterminated quoted value")
+}
+
+// Reports whether the label matchers of a selector match a series.
+func (s selector) matchLabels(labels []prompb.Label) bool {
+	for _, m := range s.matchers {
+		if !m.match(labelValue(labels, m.name)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reports whether a label value matches.
+func (m labelMatcher) match(value string) bool {
+	switch m.op {
+	case matchEqual:
+		return value == m.value
+	case matchNotEqual:
+		return value != m.value
+	case matchRegexp:
+		return m.regexp.MatchString(value)
+	case matchNotRegexp:
+		return !m.regexp.MatchString(value)
+	}
+
+	return false
+}
+
+// Value of a label, which is empty when the label is not present.
+func labelValue(labels []prompb.Label, name string) string {
+	for _, label := range labels {
+		if label.Name == name {
+			return label.Value
+		}
+	}
+
+	return ""
+}
+
+// Compiles a set of selectors.
+func newSelectorSet(values []string) (*selectorSet, error) {
+	set := &selectorSet{
+		cache: make(map[string][]int),
+	}
+
+	for _, value := range values {
+		s, err := parseSelector(value)
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := compilePattern(s.name)
+		if err != nil {
+			return nil, err
+		}
+
+		set.selectors = append(set.selectors, s)
+		set.patterns = append(set.patterns, p)
+	}
+
+	return set, nil
+}
+
+// Returns the index of the first selector which matches any of the names and the labels of a series. Selectors are
+// matched in the order they were declared, whichever of the names they match.
+func (set *selectorSet) match(names []string, labels []prompb.Label) (int, bool) {
+	var (
+		first int
+		found bool
+	)
+
+	for _, name := range names {
+		// Candidates are in the order they were declared, so the rest are declared after the selector already found.
+		for _, i := range set.candidates(name) {
+			if found && i >= first {
+				break
+			}
+
+			if set.selectors[i].matchLabels(labels) {
+				first, found = i, true
+				break
+			}
+		}
+	}
+
+	return first, found
+}
+
+// Selectors which match a name, before their label matchers are evaluated.
+func (set *selectorSet) candidates(name string) []int {
+	set.mutex.RLock()
+	candidates, ok := set.cache[name]
+	set.mutex.RUnlock()
+
+	if ok {
+		return candidates
+	}
+
+	for i, s := range set.selectors {
+		if s.name == "" || set.patterns[i].match(name) {
+			candidates = append(candidates, i)
+		}
+	}
+
+	set.mutex.Lock()
+	if len(set.cache) >= matcherCacheSize {
+		set.cache = make(map[string][]int)
+	}
+	set.cache[name] = candidates
+	set.mutex.Unlock()
+
+	return candidates
+}
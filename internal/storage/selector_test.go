@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelector(t *testing.T) {
+	labels := []prompb.Label{
+		{Name: "namespace", Value: "prod-web"},
+		{Name: "code", Value: "500"},
+	}
+
+	tests := []struct {
+		selector string
+		name     string
+		want     bool
+	}{
+		{`http_requests_total`, "http_requests_total", true},
+		{`http_requests_total{}`, "http_requests_total", true},
+		{`http_requests_total{namespace="prod-web"}`, "http_requests_total", true},
+		{`http_requests_total{namespace="dev"}`, "http_requests_total", false},
+		{`http_requests_total{namespace=~"prod-.*",code!="200"}`, "http_requests_total", true},
+		{`http_requests_total{namespace=~"prod",code!="200"}`, "http_requests_total", false},
+		{`http_requests_total{namespace!~"dev|ci", code=~"5.."}`, "http_requests_total", true},
+		{`http_requests_total{job=""}`, "http_requests_total", true},
+		{`http_requests_total{code=~` + "`5\\d\\d`" + `}`, "http_requests_total", true},
+		{`{code="500"}`, "", true},
+		{`/node_.{4}/{code="500"}`, "/node_.{4}/", true},
+	}
+
+	for _, test := range tests {
+		s, err := parseSelector(test.selector)
+		assert.Nil(t, err, test.selector)
+		assert.Equal(t, test.name, s.name, test.selector)
+		assert.Equal(t, test.want, s.matchLabels(labels), test.selector)
+	}
+}
+
+func TestSelectorInvalid(t *testing.T) {
+	for _, value := range []string{
+		`http_requests_total{`,
+		`http_requests_total{code}`,
+		`http_requests_total{code=200}`,
+		`http_requests_total{code="200}`,
+		`http_requests_total{code=~"("}`,
+		`http_requests_total{code="200" job="x"}`,
+		`{}`,
+	} {
+		_, err := parseSelector(value)
+		assert.Error(t, err, value)
+	}
+}
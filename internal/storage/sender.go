@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+// Sender which pushes batches to CloudWatch.
+type Sender struct {
+	logger     Logger
+	svc        cloudwatchiface.CloudWatchAPI
+	retry      RetryParams
+	deadletter DeadLetter
+	// Used in place of the clock by tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewSender for pushing batches to CloudWatch. The CloudWatch client is shared, so it is safe to call Send concurrently.
+// Datums which CloudWatch rejects are discarded when the dead-letter sink is nil.
+func NewSender(logger Logger, svc cloudwatchiface.CloudWatchAPI, retry RetryParams, deadletter DeadLetter) (*Sender, error) {
+	if err := retry.Validate(); err != nil {
+		return nil, err
+	}
+
+	sender := &Sender{
+		logger:     logger,
+		svc:        svc,
+		retry:      retry,
+		deadletter: deadletter,
+		now:        time.Now,
+		sleep:      time.Sleep,
+	}
+
+	return sender, nil
+}
+
+// Send a batch to CloudWatch. Batches which fail with a retryable error are retried with exponential backoff until
+// the retry budget or the maximum elapsed time has been used up.
+//
+// Batches which CloudWatch rejects because of an invalid parameter are split in half until the datums which caused
+// the rejection are found, so the rest of the batch can still be pushed. Rejected datums are sent to the dead-letter
+// sink. The retry budget is shared by every request made for the batch.
+//
+// A SendError is returned with the datums which were not pushed when the batch could not be pushed in full.
+func (s *Sender) Send(batch Batch) error {
+	if len(batch.Data) == 0 {
+		return nil
+	}
+
+	s.logger.Infof("Pushing metrics: %d", len(batch.Data))
+
+	remainder, err := s.bisect(batch, &retryState{start: s.now()})
+	if err != nil {
+		datumsFailed.Add(float64(len(remainder.Data)))
+		return &SendError{Err: err, Batch: remainder}
+	}
+
+	return nil
+}
+
+// Pushes a batch, splitting it in half when CloudWatch rejects a parameter. Returns the datums which were not pushed
+// when it fails.
+func (s *Sender) bisect(batch Batch, state *retryState) (Batch, error) {
+	err := s.put(batch.Namespace, batch.Data, state)
+	if err == nil {
+		return Batch{}, nil
+	}
+
+	if !Rejected(err) {
+		return batch, err
+	}
+
+	if len(batch.Data) == 1 {
+		s.reject(batch, err)
+		return Batch{}, nil
+	}
+
+	batchesBisected.WithLabelValues(ErrorCode(err)).Inc()
+
+	var (
+		middle = len(batch.Data) / 2
+		second = batch.slice(middle, len(batch.Data))
+	)
+
+	remainder, err := s.bisect(batch.slice(0, middle), state)
+	if err != nil {
+		return remainder.join(second), err
+	}
+
+	return s.bisect(second, state)
+}
+
+// Pushes datums in a single request, retrying if it fails with a retryable error.
+func (s *Sender) put(namespace string, data []*cloudwatch.MetricDatum, state *retryState) error {
+	input := &cloudwatch.PutMetricDataInput{
+		Namespace:  aws.String(namespace),
+		MetricData: data,
+	}
+
+	for {
+		_, err := s.svc.PutMetricData(input)
+		if err == nil {
+			break
+		}
+
+		if !Retryable(err) {
+			return err
+		}
+
+		code := ErrorCode(err)
+
+		delay := s.retry.delay(state.retries)
+
+		if state.retries >= s.retry.MaxRetries || (s.retry.MaxElapsed > 0 && s.now().Add(delay).Sub(state.start) > s.retry.MaxElapsed) {
+			batchesGivenUp.WithLabelValues(code).Inc()
+			return err
+		}
+
+		state.retries++
+
+		s.logger.Infof("Retrying metrics in %s: %s", delay, err)
+		batchRetries.WithLabelValues(code).Inc()
+		s.sleep(delay)
+	}
+
+	for _, datum := range data {
+		datumsPushed.WithLabelValues(strconv.FormatInt(storageResolution(datum), 10)).Inc()
+	}
+
+	return nil
+}
+
+// Logs a datum which CloudWatch rejected and sends it to the dead-letter sink.
+func (s *Sender) reject(batch Batch, err error) {
+	var (
+		code  = ErrorCode(err)
+		datum = batch.Data[0]
+	)
+
+	s.logger.Errorf("Metric was rejected by CloudWatch: %s/%s%s: %s", batch.Namespace, aws.StringValue(datum.MetricName), formatDimensions(datum.Dimensions), err)
+	datumsFailed.Inc()
+	datumsRejected.WithLabelValues(code).Inc()
+
+	if s.deadletter == nil {
+		return
+	}
+
+	if err := s.deadletter.Write(batch.DeadLetters(code)...); err != nil {
+		s.logger.Errorf("Failed to write metric to dead-letter sink: %s", err)
+	}
+}
+
+// Formats dimensions the same way as Prometheus labels eg. {instance="foo",job="bar"}.
+func formatDimensions(dimensions []*cloudwatch.Dimension) string {
+	pairs := make([]string, len(dimensions))
+
+	for i, dimension := range dimensions {
+		pairs[i] = fmt.Sprintf("%s=%q", aws.StringValue(dimension.Name), aws.StringValue(dimension.Value))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Storage resolution of a datum in seconds.
+func storageResolution(datum *cloudwatch.MetricDatum) int64 {
+	if datum.StorageResolution == nil {
+		return int64(StandardResolution.Seconds())
+	}
+
+	return *datum.StorageResolution
+}
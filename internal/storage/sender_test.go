@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+
+	mockcloudwatch "github.com/skpr/prometheus-cloudwatch/internal/storage/mock/cloudwatch"
+	mocklog "github.com/skpr/prometheus-cloudwatch/internal/storage/mock/log"
+)
+
+func TestSender(t *testing.T) {
+	var (
+		logger = mocklog.New()
+		svc    = mockcloudwatch.New()
+	)
+
+	sender, err := NewSender(logger, svc, RetryParams{}, nil)
+	assert.Nil(t, err)
+
+	batch := Batch{
+		Namespace: "test",
+		Data: []*cloudwatch.MetricDatum{
+			{
+				MetricName: aws.String("metric1"),
+				Values:     []*float64{aws.Float64(1)},
+			},
+		},
+	}
+
+	assert.Nil(t, sender.Send(batch))
+
+	// Empty batches are not pushed.
+	assert.Nil(t, sender.Send(Batch{Namespace: "test"}))
+
+	assert.Len(t, svc.Inputs, 1)
+	assert.Equal(t, "test", *svc.Inputs[0].Namespace)
+	assert.Equal(t, batch.Data, svc.Inputs[0].MetricData)
+	assert.Equal(t, []string{"Pushing metrics: 1"}, logger.Messages)
+}
+
+func TestSenderRetry(t *testing.T) {
+	var (
+		throttled = awserr.NewRequestFailure(awserr.New("Throttling", "Rate exceeded", nil), 400, "1")
+		fault     = awserr.NewRequestFailure(awserr.New(cloudwatch.ErrCodeInternalServiceFault, "Internal", nil), 500, "2")
+		denied    = awserr.NewRequestFailure(awserr.New("AccessDenied", "Denied", nil), 403, "3")
+	)
+
+	tests := []struct {
+		name   string
+		retry  RetryParams
+		errs   []error
+		err    error
+		calls  int
+		pushed bool
+	}{
+		{
+			name:   "retry until pushed",
+			retry:  RetryParams{MaxRetries: 3, BaseDelay: time.Second, MaxDelay: time.Minute},
+			errs:   []error{throttled, fault, errors.New("connection reset by peer")},
+			calls:  4,
+			pushed: true,
+		},
+		{
+			name:  "retry budget",
+			retry: RetryParams{MaxRetries: 2, BaseDelay: time.Second, MaxDelay: time.Minute},
+			errs:  []error{throttled, throttled, throttled},
+			err:   throttled,
+			calls: 3,
+		},
+		{
+			name:  "max elapsed",
+			retry: RetryParams{MaxRetries: 10, BaseDelay: time.Minute, MaxDelay: time.Minute, MaxElapsed: time.Minute},
+			errs:  []error{fault, fault, fault},
+			err:   fault,
+			calls: 2,
+		},
+		{
+			name:  "client errors are not retried",
+			retry: RetryParams{MaxRetries: 3, BaseDelay: time.Second, MaxDelay: time.Minute},
+			errs:  []error{denied},
+			err:   denied,
+			calls: 1,
+		},
+	}
+
+	for _, test := range tests {
+		svc := mockcloudwatch.New()
+		svc.Errs = test.errs
+
+		sender, err := NewSender(mocklog.New(), svc, test.retry, nil)
+		assert.Nil(t, err, test.name)
+
+		// The clock moves on by the delay of each retry, which is always the longest it can be.
+		now := time.Now()
+		sender.now = func() time.Time { return now }
+		sender.sleep = func(delay time.Duration) { now = now.Add(test.retry.MaxDelay) }
+
+		err = sender.Send(Batch{
+			Namespace: "test",
+			Data:      []*cloudwatch.MetricDatum{{MetricName: aws.String("metric1")}},
+		})
+
+		assert.Equal(t, test.err, cause(err), test.name)
+		assert.Equal(t, test.calls, svc.Calls, test.name)
+		assert.Equal(t, test.pushed, len(svc.Inputs) == 1, test.name)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	retry := RetryParams{MaxRetries: 100, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+
+	for attempt := 0; attempt < 100; attempt++ {
+		delay := retry.delay(attempt)
+		assert.True(t, delay >= 0)
+		assert.True(t, delay <= retry.MaxDelay)
+
+		if attempt == 0 {
+			assert.True(t, delay <= retry.BaseDelay)
+		}
+	}
+}
+
+func TestRetryValidate(t *testing.T) {
+	assert.Nil(t, RetryParams{}.Validate())
+	assert.NotNil(t, RetryParams{MaxRetries: -1}.Validate())
+	assert.NotNil(t, RetryParams{MaxRetries: 1}.Validate())
+	assert.NotNil(t, RetryParams{MaxRetries: 1, BaseDelay: time.Minute, MaxDelay: time.Second}.Validate())
+}
+
+// Dead-letter sink which keeps entries in memory.
+type mockDeadLetter struct {
+	entries []DeadLetterEntry
+}
+
+func (m *mockDeadLetter) Write(entries ...DeadLetterEntry) error {
+	m.entries = append(m.entries, entries...)
+	return nil
+}
+
+func TestSenderBisect(t *testing.T) {
+	var (
+		logger     = mocklog.New()
+		svc        = mockcloudwatch.New()
+		deadletter = &mockDeadLetter{}
+	)
+
+	// Rejects any request which includes a datum named bad.
+	svc.Validate = func(input *cloudwatch.PutMetricDataInput) error {
+		for _, datum := range input.MetricData {
+			if *datum.MetricName == "bad" {
+				return awserr.NewRequestFailure(awserr.New(cloudwatch.ErrCodeInvalidParameterValueException, "Invalid", nil), 400, "1")
+			}
+		}
+
+		return nil
+	}
+
+	sender, err := NewSender(logger, svc, RetryParams{}, deadletter)
+	assert.Nil(t, err)
+
+	batch := Batch{Namespace: "test"}
+
+	for _, name := range []string{"metric1", "bad", "metric2", "metric3", "metric4", "bad"} {
+		batch.Data = append(batch.Data, &cloudwatch.MetricDatum{
+			MetricName: aws.String(name),
+			Dimensions: []*cloudwatch.Dimension{{Name: aws.String("foo"), Value: aws.String("bar")}},
+		})
+		batch.Labels = append(batch.Labels, []Labels{{"__name__": name, "foo": "bar"}})
+	}
+
+	assert.Nil(t, sender.Send(batch))
+
+	var pushed []string
+
+	for _, input := range svc.Inputs {
+		for _, datum := range input.MetricData {
+			pushed = append(pushed, *datum.MetricName)
+		}
+	}
+
+	assert.Equal(t, []string{"metric1", "metric2", "metric3", "metric4"}, pushed)
+	assert.Equal(t, []DeadLetterEntry{
+		{
+			Namespace: "test",
+			Datum:     batch.Data[1],
+			Code:      cloudwatch.ErrCodeInvalidParameterValueException,
+			Labels:    []Labels{{"__name__": "bad", "foo": "bar"}},
+		},
+		{
+			Namespace: "test",
+			Datum:     batch.Data[5],
+			Code:      cloudwatch.ErrCodeInvalidParameterValueException,
+			Labels:    []Labels{{"__name__": "bad", "foo": "bar"}},
+		},
+	}, deadletter.entries)
+	assert.Contains(t, logger.Messages, `Metric was rejected by CloudWatch: test/bad{foo="bar"}: InvalidParameterValue: Invalid
+	status code: 400, request id: 1`)
+}
+
+func TestSenderBisectRetry(t *testing.T) {
+	var (
+		throttled = awserr.NewRequestFailure(awserr.New("Throttling", "Rate exceeded", nil), 400, "1")
+		invalid   = awserr.NewRequestFailure(awserr.New(cloudwatch.ErrCodeInvalidParameterValueException, "Invalid", nil), 400, "2")
+	)
+
+	tests := []struct {
+		name string
+		// Names of the datums in the batch.
+		names []string
+		// Error returned for each request in turn, after which requests with a datum named bad are rejected.
+		errs      []error
+		retries   int
+		remainder []string
+		rejected  int
+	}{
+		{
+			name:      "retryable failure after part of the batch was pushed",
+			names:     []string{"bad", "metric1", "metric2", "metric3"},
+			errs:      []error{nil, nil, nil, nil, throttled, throttled, throttled},
+			retries:   2,
+			remainder: []string{"metric2", "metric3"},
+			rejected:  1,
+		},
+		{
+			name:  "retry budget is shared by the bisected requests",
+			names: []string{"metric1", "bad"},
+			// The first request uses up the budget, so the bisected request is not retried.
+			errs:      []error{throttled, nil, throttled},
+			retries:   1,
+			remainder: []string{"metric1", "bad"},
+		},
+	}
+
+	for _, test := range tests {
+		var (
+			svc        = mockcloudwatch.New()
+			deadletter = &mockDeadLetter{}
+			calls      int
+		)
+
+		svc.Validate = func(input *cloudwatch.PutMetricDataInput) error {
+			calls++
+
+			if calls <= len(test.errs) && test.errs[calls-1] != nil {
+				return test.errs[calls-1]
+			}
+
+			for _, datum := range input.MetricData {
+				if *datum.MetricName == "bad" {
+					return invalid
+				}
+			}
+
+			return nil
+		}
+
+		sender, err := NewSender(mocklog.New(), svc, RetryParams{MaxRetries: test.retries, BaseDelay: time.Second, MaxDelay: time.Second}, deadletter)
+		assert.Nil(t, err, test.name)
+
+		sender.sleep = func(time.Duration) {}
+
+		batch := Batch{Namespace: "test"}
+
+		for _, name := range test.names {
+			batch.Data = append(batch.Data, &cloudwatch.MetricDatum{MetricName: aws.String(name)})
+			batch.Labels = append(batch.Labels, []Labels{{"__name__": name}})
+		}
+
+		err = sender.Send(batch)
+		assert.IsType(t, &SendError{}, err, test.name)
+		assert.Equal(t, throttled, cause(err), test.name)
+
+		var remainder []string
+
+		for i, datum := range err.(*SendError).Batch.Data {
+			remainder = append(remainder, *datum.MetricName)
+			assert.Equal(t, []Labels{{"__name__": *datum.MetricName}}, err.(*SendError).Batch.Labels[i], test.name)
+		}
+
+		assert.Equal(t, test.remainder, remainder, test.name)
+		assert.Len(t, deadletter.entries, test.rejected, test.name)
+
+		// Datums which were pushed are not part of the remainder.
+		for _, input := range svc.Inputs {
+			for _, datum := range input.MetricData {
+				assert.NotContains(t, remainder, *datum.MetricName, test.name)
+			}
+		}
+	}
+}
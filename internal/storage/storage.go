@@ -2,106 +2,586 @@ package storage
 
 import (
 	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
-	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
 	"github.com/prometheus/prometheus/prompb"
 
+	"github.com/skpr/prometheus-cloudwatch/internal/relabel"
 	storageutils "github.com/skpr/prometheus-cloudwatch/internal/storage/utils"
 )
 
+const (
+	// AggregationValues publishes buffered samples as a Values/Counts pair.
+	AggregationValues = "values"
+	// AggregationStatistics publishes buffered samples as a StatisticSet.
+	AggregationStatistics = "statistics"
+
+	// CounterRate converts a counter to a per-second rate.
+	CounterRate = "rate"
+	// CounterDelta converts a counter to the increase since the previous sample.
+	CounterDelta = "delta"
+	// CounterExpiry after which the state kept for a counter which has not been seen is discarded.
+	CounterExpiry = time.Hour
+
+	// StandardResolution which samples are grouped by before being pushed.
+	StandardResolution = time.Minute
+	// HighResolution which samples are grouped by for metrics stored with 1 second resolution.
+	HighResolution = time.Second
+	// MaxSampleAge which CloudWatch accepts, less an hour to allow for time spent queued.
+	MaxSampleAge = 14*24*time.Hour - time.Hour
+	// MaxSampleSkew which CloudWatch accepts for samples in the future.
+	MaxSampleSkew = 2 * time.Hour
+
+	// Value Prometheus uses to mark a series which has disappeared.
+	staleNaN = 0x7ff0000000000002
+
+	// Separates the namespace from the rest of a datum key. Namespaces cannot contain control characters.
+	keySeparator = "\x00"
+)
+
 // Interface for interacting with CloudWatch metrics storage.
 type Interface interface {
 	Add(prompb.TimeSeries) error
-	Flush() error
+	Flush() []Batch
+	Replay([]DeadLetterEntry) []Batch
 }
 
-// Client for interacting with CloudWatch metrics storage.
+// Client which converts and aggregates Prometheus samples into batches for CloudWatch.
 type Client struct {
 	logger    Logger
-	svc       cloudwatchiface.CloudWatchAPI
 	namespace string
 	batch     int
 	whitelist Whitelist
-	data      []*cloudwatch.MetricDatum
+	rules     *rules
+	labels    *matcher
+	deny      *denylist
+	static    []*cloudwatch.Dimension
+	router    *router
+
+	mutex      sync.Mutex
+	series     map[string]*series
+	histograms map[string]*histogram
+	summaries  map[string]*summary
+	rollups    map[string]*rollup
+	counters   map[string]*counter
+	now        func() time.Time
+}
+
+// Samples which have been buffered for a single series and period until the next flush.
+type series struct {
+	name       *string
+	dimensions []*cloudwatch.Dimension
+	timestamp  *time.Time
+	unit       string
+	resolution *int64
+	values     []float64
+	// Samples by the Prometheus series they came from, which can collide once labels are dropped.
+	members   map[string][]float64
+	sources   sources
+	last      string
+	collision string
+	delta     bool
 }
 
-// Whitelist which governs which metrics are pushed to CloudWatch.
-type Whitelist struct {
-	Metrics []string `json:"metrics" yaml:"metrics"`
-	Labels  []string `json:"labels"  yaml:"labels"`
+// Batch of datums which are pushed to CloudWatch in a single request.
+type Batch struct {
+	Namespace string                    `json:"namespace"`
+	Data      []*cloudwatch.MetricDatum `json:"data"`
+	// Labels of the Prometheus series each datum came from, in the same order as the data. Empty for datums which do
+	// not come from a single series eg. rollups.
+	Labels [][]Labels `json:"labels,omitempty"`
 }
 
-// New client for pushing CloudWatch metrics.
-func New(logger Logger, svc cloudwatchiface.CloudWatchAPI, namespace string, batch int, whitelist Whitelist) (Interface, error) {
+// New client for aggregating CloudWatch metrics.
+func New(logger Logger, namespace string, batch int, whitelist Whitelist) (Interface, error) {
+	if whitelist.Aggregation == "" {
+		whitelist.Aggregation = AggregationValues
+	}
+
+	if whitelist.Collision == "" {
+		whitelist.Collision = CollisionDistribution
+	}
+
 	client := &Client{
-		logger:    logger,
-		svc:       svc,
-		namespace: namespace,
-		batch:     batch,
-		whitelist: whitelist,
+		logger:     logger,
+		namespace:  namespace,
+		batch:      batch,
+		whitelist:  whitelist,
+		series:     make(map[string]*series),
+		histograms: make(map[string]*histogram),
+		summaries:  make(map[string]*summary),
+		rollups:    make(map[string]*rollup),
+		counters:   make(map[string]*counter),
+		now:        time.Now,
 	}
 
 	if len(whitelist.Metrics) == 0 {
 		return client, errors.New("metrics whitelist was not provided")
 	}
 
-	if len(whitelist.Labels) == 0 {
-		return client, errors.New("labels whitelist was not provided")
+	for _, metric := range whitelist.Metrics {
+		if err := metric.Validate(); err != nil {
+			return client, err
+		}
+	}
+
+	for _, config := range whitelist.RelabelConfigs {
+		if config == nil {
+			return client, errors.New("relabel config was empty")
+		}
+
+		if err := config.Validate(); err != nil {
+			return client, err
+		}
+	}
+
+	if whitelist.Aggregation != AggregationValues && whitelist.Aggregation != AggregationStatistics {
+		return client, fmt.Errorf("aggregation not supported: %s", whitelist.Aggregation)
+	}
+
+	if err := validateCollision(whitelist.Collision); err != nil {
+		return client, err
 	}
 
+	if err := client.whitelist.Validation.defaults(); err != nil {
+		return client, err
+	}
+
+	rules, err := newRules(whitelist.Metrics)
+	if err != nil {
+		return client, err
+	}
+
+	labels, err := newMatcher(whitelist.Labels)
+	if err != nil {
+		return client, err
+	}
+
+	deny, err := newDenylist(whitelist.Deny)
+	if err != nil {
+		return client, err
+	}
+
+	for _, metric := range whitelist.Metrics {
+		if err := deny.strict(metric); err != nil {
+			return client, err
+		}
+	}
+
+	static, err := staticDimensions(whitelist)
+	if err != nil {
+		return client, err
+	}
+
+	router, err := newRouter(namespace, whitelist.Namespaces)
+	if err != nil {
+		return client, err
+	}
+
+	client.rules = rules
+	client.labels = labels
+	client.deny = deny
+	client.static = static
+	client.router = router
+
 	return client, nil
 }
 
-// Add a metric to storage.
+// Add a metric to storage. Samples are buffered per series and period until the next flush.
 func (c *Client) Add(ts prompb.TimeSeries) error {
-	metric, err := storageutils.TimeSeriesToCloudWatch(ts, c.whitelist.Labels)
+	samplesReceived.Add(float64(len(ts.Samples)))
+
+	original := ts.Labels
+
+	if len(c.whitelist.RelabelConfigs) > 0 {
+		ts.Labels = relabel.Process(ts.Labels, c.whitelist.RelabelConfigs...)
+		if ts.Labels == nil {
+			samplesDropped.WithLabelValues(reasonRelabel).Add(float64(len(ts.Samples)))
+			return nil
+		}
+	}
+
+	name := storageutils.MetricName(ts.Labels)
+	if name == "" {
+		c.logger.Infof("Skipping because no metric name was found")
+		samplesDropped.WithLabelValues(reasonInvalid).Add(float64(len(ts.Samples)))
+		return nil
+	}
+
+	rule, suffix, ok := c.rules.metric(name, ts.Labels)
+	if !ok {
+		c.logger.Infof("Skipping because metric has not been whitelisted: %s", name)
+		samplesDropped.WithLabelValues(reasonWhitelist).Add(float64(len(ts.Samples)))
+		return nil
+	}
+
+	// The rule may be a pattern, so it is named after the metric family it matched.
+	rule.Name = strings.TrimSuffix(name, suffix)
+
+	names := []string{name}
+	if rule.Name != name {
+		names = append(names, rule.Name)
+	}
+
+	if c.deny.deny(names, ts.Labels) {
+		c.logger.Infof("Skipping because metric has been denied: %s", name)
+		samplesDropped.WithLabelValues(reasonDeny).Add(float64(len(ts.Samples)))
+		return nil
+	}
+
+	namespace, err := c.router.namespace(names, ts.Labels)
+	if err != nil {
+		c.logger.Errorf("Skipping because namespace could not be routed: %s: %s", name, err)
+		samplesDropped.WithLabelValues(reasonNamespace).Add(float64(len(ts.Samples)))
+		return nil
+	}
+
+	rule.namespace = namespace
+	rule.labels = original
+
+	if rule.StrictDimensions && !strict(rule, ts.Labels) {
+		c.logger.Infof("Skipping because dimensions were not found: %s", name)
+		samplesDropped.WithLabelValues(reasonDimensions).Add(float64(len(ts.Samples)))
+		return nil
+	}
+
+	now := c.now()
+
+	switch rule.Type {
+	case TypeHistogram:
+		return c.addHistogram(ts, rule, suffix, now)
+	case TypeSummary:
+		return c.addSummary(ts, rule, suffix, now)
+	}
+
+	return c.addSeries(ts, rule, c.unit(name, rule), c.dimensions(rule, ts.Labels), now)
+}
+
+// Adds the samples of a single series, using the given labels as dimensions.
+func (c *Client) addSeries(ts prompb.TimeSeries, rule Metric, unit metricUnit, labels []string, now time.Time) error {
+	name := storageutils.MetricName(ts.Labels)
+
+	if rule.Counter != "" {
+		c.mutex.Lock()
+		ts = c.convertCounter(ts, rule.Counter, now)
+		c.mutex.Unlock()
+	}
+
+	metrics, err := storageutils.TimeSeriesToCloudWatch(ts, labels, rule.period())
 	if err != nil {
+		samplesDropped.WithLabelValues(reasonInvalid).Add(float64(len(ts.Samples)))
 		return err
 	}
 
-	if !storageutils.Contains(c.whitelist.Metrics, *metric.MetricName) {
-		c.logger.Infof("Skipping because metric has not been whitelisted: %s", *metric.MetricName)
+	var values int
+
+	for _, metric := range metrics {
+		values += len(metric.Values)
+	}
+
+	for _, sample := range ts.Samples {
+		if math.IsNaN(sample.Value) {
+			samplesDropped.WithLabelValues(nanReason(sample.Value)).Inc()
+		}
+	}
+
+	if values == 0 {
+		if rule.Counter == "" {
+			c.logger.Infof("Skipping because no values were found: %s", name)
+		}
+
 		return nil
 	}
 
-	if len(metric.Dimensions) == 0 {
-		c.logger.Infof("Skipping because no dimensions were found: %s", *metric.MetricName)
+	// Static dimensions are merged first, so a series with only static dimensions is still published. Series without
+	// any dimensions can still be published as part of a rollup.
+	var (
+		dimensions = c.withStatic(metrics[0].Dimensions, ts.Labels)
+		publish    = len(dimensions) > 0 || c.allowNoDimensions(rule)
+	)
+
+	if !publish && len(rule.Rollups) == 0 {
+		c.logger.Infof("Skipping because no dimensions were found: %s", name)
+		samplesDropped.WithLabelValues(reasonDimensions).Add(float64(values))
 		return nil
 	}
 
-	if len(metric.Values) == 0 {
-		c.logger.Infof("Skipping because no values were found: %s", *metric.MetricName)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var periods []*cloudwatch.MetricDatum
+
+	for _, metric := range metrics {
+		if accepted(*metric.Timestamp, now, len(metric.Values)) {
+			periods = append(periods, metric)
+		}
+	}
+
+	c.addRollups(ts, rule, unit, periods)
+
+	if !publish {
 		return nil
 	}
 
-	c.data = append(c.data, metric)
+	member := storageutils.LabelsKey(ts.Labels)
+
+	for _, metric := range periods {
+		metric.MetricName = aws.String(unit.name)
+		metric.Dimensions = dimensions
+
+		key := datumKey(rule.namespace, metric)
+
+		s, ok := c.series[key]
+		if !ok {
+			s = &series{
+				name:       metric.MetricName,
+				dimensions: metric.Dimensions,
+				timestamp:  metric.Timestamp,
+				unit:       unit.unit,
+				resolution: rule.storageResolution(),
+				collision:  c.collision(rule),
+				delta:      rule.Counter == CounterDelta,
+			}
 
-	if len(c.data) >= c.batch {
-		return c.Flush()
+			c.series[key] = s
+		}
+
+		values := make([]float64, len(metric.Values))
+		for i, value := range metric.Values {
+			values[i] = *value * unit.scale
+		}
+
+		s.add(member, values)
+		s.sources.add(member, rule.labels)
 	}
 
 	return nil
 }
 
-// Flush all records kept in memory.
-func (c *Client) Flush() error {
-	if len(c.data) > 0 {
-		c.logger.Infof("Pushing metrics: %d", len(c.data))
+// Flush all records kept in memory as one datum per series, split into batches which stay within the limits of a
+// PutMetricData request.
+func (c *Client) Flush() []Batch {
+	c.mutex.Lock()
+	buffered := c.series
+	histograms := c.histograms
+	summaries := c.summaries
+	rollups := c.rollups
+	c.series = make(map[string]*series)
+	c.histograms = make(map[string]*histogram)
+	c.summaries = make(map[string]*summary)
+	c.rollups = make(map[string]*rollup)
+	c.expireCounters(c.now())
+	c.mutex.Unlock()
+
+	var (
+		datums = make(map[string]*cloudwatch.MetricDatum, len(buffered)+len(histograms))
+		labels = make(map[string][]Labels, len(buffered)+len(histograms))
+	)
 
-		input := &cloudwatch.PutMetricDataInput{
-			Namespace:  aws.String(c.namespace),
-			MetricData: c.data,
+	for key, s := range buffered {
+		datums[key] = c.datum(s)
+		labels[key] = s.sources.labels()
+	}
+
+	for key, h := range histograms {
+		if datum := h.datum(); datum != nil {
+			datums[key] = datum
+			labels[key] = h.sources.labels()
 		}
+	}
 
-		_, err := c.svc.PutMetricData(input)
-		if err != nil {
-			return err
+	for key, s := range summaries {
+		if datum := s.datum(); datum != nil {
+			datums[key] = datum
+			labels[key] = s.sources.labels()
 		}
+	}
 
-		c.data = nil
+	for key, r := range rollups {
+		datums[key] = c.datum(r.aggregate())
 	}
 
-	return nil
+	keys := make([]string, 0, len(datums))
+	highResolution := make(map[string]bool)
+
+	for key, datum := range datums {
+		keys = append(keys, key)
+
+		if storageResolution(datum) == 1 {
+			highResolution[storageutils.Key(&cloudwatch.MetricDatum{MetricName: datum.MetricName, Dimensions: datum.Dimensions})] = true
+		}
+	}
+
+	highResolutionMetrics.Set(float64(len(highResolution)))
+
+	// Sorted so batches are deterministic. Keys start with the namespace, so datums for a namespace are together.
+	sort.Strings(keys)
+
+	batcher := newBatcher(c.batch)
+
+	for _, key := range keys {
+		namespace := keyNamespace(key)
+
+		for _, datum := range c.whitelist.Validation.validate(datums[key]) {
+			batcher.add(namespace, datum, labels[key])
+		}
+	}
+
+	return batcher.batches
+}
+
+// Replay datums which could not be pushed, validating them again so changes to the configuration are applied, and
+// split them into batches.
+func (c *Client) Replay(entries []DeadLetterEntry) []Batch {
+	// Sorted so datums for a namespace are together.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Namespace < entries[j].Namespace
+	})
+
+	batcher := newBatcher(c.batch)
+
+	for _, entry := range entries {
+		for _, datum := range c.whitelist.Validation.validate(entry.Datum) {
+			batcher.add(entry.Namespace, datum, entry.Labels)
+		}
+	}
+
+	return batcher.batches
+}
+
+// Key which uniquely identifies the namespace, series and period a datum belongs to.
+func datumKey(namespace string, datum *cloudwatch.MetricDatum) string {
+	return namespace + keySeparator + storageutils.Key(datum)
+}
+
+// Namespace of a datum key.
+func keyNamespace(key string) string {
+	return key[:strings.Index(key, keySeparator)]
+}
+
+// Resolves the unit a metric is pushed with.
+func (c *Client) unit(name string, rule Metric) metricUnit {
+	return resolveUnit(name, rule, c.whitelist.StripUnitSuffix)
+}
+
+// Collision policy for series of a metric which collapse into the same datum.
+func (c *Client) collision(rule Metric) string {
+	if rule.Collision != "" {
+		return rule.Collision
+	}
+
+	return c.whitelist.Collision
+}
+
+// Reports whether a metric can be published without any dimensions.
+func (c *Client) allowNoDimensions(rule Metric) bool {
+	return rule.AllowNoDimensions || c.whitelist.AllowNoDimensions
+}
+
+// Names of the labels which are used as dimensions for a series. The dimensions of the rule are used instead of the
+// global list when they have been provided. The series is counted once against each deny rule which removed a
+// dimension.
+func (c *Client) dimensions(rule Metric, labels []prompb.Label) []string {
+	var names, denied []string
+
+	matcher := c.labels
+	if rule.dimensions != nil {
+		matcher = rule.dimensions
+	}
+
+	for _, label := range labels {
+		if !matcher.match(label.Name) {
+			continue
+		}
+
+		if value, ok := c.deny.dimension(label.Name); ok {
+			if !containsString(denied, value) {
+				denied = append(denied, value)
+			}
+
+			continue
+		}
+
+		names = append(names, label.Name)
+	}
+
+	for _, value := range denied {
+		dimensionsDenied.WithLabelValues(value).Inc()
+	}
+
+	return names
+}
+
+// Reports whether a slice contains a string.
+func containsString(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reports whether a series has every dimension of a rule with strict dimensions.
+func strict(rule Metric, labels []prompb.Label) bool {
+	for _, name := range rule.Dimensions {
+		if labelValue(labels, name) == "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reason a NaN sample is dropped, which is either a staleness marker or a NaN value.
+func nanReason(value float64) string {
+	if math.Float64bits(value) == staleNaN {
+		return reasonStale
+	}
+
+	return reasonNaN
+}
+
+// Reports whether CloudWatch will accept a datum with this timestamp, counting the samples which are dropped.
+// CloudWatch rejects the whole request if a single datum is outside the window it accepts.
+func accepted(timestamp, now time.Time, samples int) bool {
+	if timestamp.Before(now.Add(-MaxSampleAge)) {
+		samplesDropped.WithLabelValues(reasonTooOld).Add(float64(samples))
+		return false
+	}
+
+	if timestamp.After(now.Add(MaxSampleSkew)) {
+		samplesDropped.WithLabelValues(reasonTooNew).Add(float64(samples))
+		return false
+	}
+
+	return true
+}
+
+// Builds a single datum from the samples buffered for a series.
+func (c *Client) datum(s *series) *cloudwatch.MetricDatum {
+	metric := &cloudwatch.MetricDatum{
+		MetricName:        s.name,
+		Dimensions:        s.dimensions,
+		Timestamp:         s.timestamp,
+		Unit:              aws.String(s.unit),
+		StorageResolution: s.resolution,
+	}
+
+	if c.whitelist.Aggregation == AggregationStatistics {
+		metric.StatisticValues = storageutils.StatisticSet(s.samples())
+		return metric
+	}
+
+	metric.Values, metric.Counts = storageutils.ValuesCounts(s.samples())
+
+	return metric
 }
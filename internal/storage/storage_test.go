@@ -1,29 +1,37 @@
 package storage
 
 import (
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/stretchr/testify/assert"
 
-	mockcloudwatch "github.com/skpr/prometheus-cloudwatch/internal/storage/mock/cloudwatch"
+	"github.com/skpr/prometheus-cloudwatch/internal/relabel"
 	mocklog "github.com/skpr/prometheus-cloudwatch/internal/storage/mock/log"
+	storageutils "github.com/skpr/prometheus-cloudwatch/internal/storage/utils"
 )
 
 func TestStorage(t *testing.T) {
+	now := storageutils.Timestamp(time.Now())
+
 	var (
 		logger    = mocklog.New()
-		svc       = mockcloudwatch.New()
 		namespace = "test"
 		batch     = 2
 		whitelist = Whitelist{
-			Metrics: []string{
-				"metric1",
-				"metric2",
-				"metric3",
-				"metric4",
-				"metric6",
+			Metrics: []Metric{
+				{Name: "metric1"},
+				{Name: "metric2"},
+				{Name: "metric3"},
+				{Name: "metric4"},
+				{Name: "metric6"},
 			},
 			Labels: []string{
 				"foo",
@@ -31,7 +39,7 @@ func TestStorage(t *testing.T) {
 		}
 	)
 
-	client, err := New(logger, svc, namespace, batch, whitelist)
+	client, err := New(logger, namespace, batch, whitelist)
 	assert.Nil(t, err)
 
 	metrics := []prompb.TimeSeries{
@@ -48,7 +56,8 @@ func TestStorage(t *testing.T) {
 			},
 			Samples: []prompb.Sample{
 				{
-					Value: 1,
+					Value:     1,
+					Timestamp: now,
 				},
 			},
 		},
@@ -65,7 +74,8 @@ func TestStorage(t *testing.T) {
 			},
 			Samples: []prompb.Sample{
 				{
-					Value: 2,
+					Value:     2,
+					Timestamp: now,
 				},
 			},
 		},
@@ -82,7 +92,8 @@ func TestStorage(t *testing.T) {
 			},
 			Samples: []prompb.Sample{
 				{
-					Value: 3,
+					Value:     3,
+					Timestamp: now,
 				},
 			},
 		},
@@ -95,7 +106,8 @@ func TestStorage(t *testing.T) {
 			},
 			Samples: []prompb.Sample{
 				{
-					Value: 4,
+					Value:     4,
+					Timestamp: now,
 				},
 			},
 		},
@@ -108,7 +120,8 @@ func TestStorage(t *testing.T) {
 			},
 			Samples: []prompb.Sample{
 				{
-					Value: 5,
+					Value:     5,
+					Timestamp: now,
 				},
 			},
 		},
@@ -131,16 +144,476 @@ func TestStorage(t *testing.T) {
 		assert.Nil(t, err)
 	}
 
-	err = client.Flush()
-	assert.Nil(t, err)
+	batches := client.Flush()
+	assert.Len(t, batches, 2)
+	assert.Len(t, batches[0].Data, 2)
+	assert.Len(t, batches[1].Data, 1)
+	assert.Equal(t, namespace, batches[0].Namespace)
 
 	logs := []string{
-		"Pushing metrics: 2",
 		"Skipping because no dimensions were found: metric4",
 		"Skipping because metric has not been whitelisted: metric5",
 		"Skipping because no values were found: metric6",
-		"Pushing metrics: 1",
 	}
 
 	assert.Equal(t, logs, logger.Messages)
+
+	// Nothing is left over once flushed.
+	assert.Empty(t, client.Flush())
+}
+
+func TestStorageAggregation(t *testing.T) {
+	now := storageutils.Timestamp(time.Now())
+	period := aws.Time(storageutils.Time(now).Truncate(StandardResolution))
+
+	ts := prompb.TimeSeries{
+		Labels: []prompb.Label{
+			{
+				Name:  model.MetricNameLabel,
+				Value: "metric1",
+			},
+			{
+				Name:  "foo",
+				Value: "bar",
+			},
+		},
+		Samples: []prompb.Sample{
+			{
+				Value:     1,
+				Timestamp: now,
+			},
+			{
+				Value:     3,
+				Timestamp: now,
+			},
+		},
+	}
+
+	tests := []struct {
+		aggregation string
+		want        *cloudwatch.MetricDatum
+	}{
+		{
+			aggregation: AggregationValues,
+			want: &cloudwatch.MetricDatum{
+				MetricName: aws.String("metric1"),
+				Dimensions: []*cloudwatch.Dimension{
+					{
+						Name:  aws.String("foo"),
+						Value: aws.String("bar"),
+					},
+				},
+				Timestamp: period,
+				Unit:      aws.String(cloudwatch.StandardUnitNone),
+				Values:    []*float64{aws.Float64(1), aws.Float64(3)},
+				Counts:    []*float64{aws.Float64(2), aws.Float64(1)},
+			},
+		},
+		{
+			aggregation: AggregationStatistics,
+			want: &cloudwatch.MetricDatum{
+				MetricName: aws.String("metric1"),
+				Dimensions: []*cloudwatch.Dimension{
+					{
+						Name:  aws.String("foo"),
+						Value: aws.String("bar"),
+					},
+				},
+				Timestamp: period,
+				Unit:      aws.String(cloudwatch.StandardUnitNone),
+				StatisticValues: &cloudwatch.StatisticSet{
+					Minimum:     aws.Float64(1),
+					Maximum:     aws.Float64(3),
+					Sum:         aws.Float64(5),
+					SampleCount: aws.Float64(3),
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		client, err := New(mocklog.New(), "test", 10, Whitelist{
+			Metrics:     []Metric{{Name: "metric1"}},
+			Labels:      []string{"foo"},
+			Aggregation: tt.aggregation,
+		})
+		assert.Nil(t, err)
+
+		// Samples from separate requests are combined into a single datum.
+		assert.Nil(t, client.Add(ts))
+		assert.Nil(t, client.Add(prompb.TimeSeries{
+			Labels:  ts.Labels,
+			Samples: []prompb.Sample{{Value: 1, Timestamp: now}},
+		}))
+
+		batches := client.Flush()
+		assert.Len(t, batches, 1)
+		assert.Equal(t, []*cloudwatch.MetricDatum{tt.want}, batches[0].Data)
+	}
+}
+
+func TestStorageTimestamps(t *testing.T) {
+	var (
+		now    = time.Now()
+		labels = []prompb.Label{
+			{
+				Name:  model.MetricNameLabel,
+				Value: "metric1",
+			},
+			{
+				Name:  "foo",
+				Value: "bar",
+			},
+		}
+	)
+
+	client, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics: []Metric{{Name: "metric1"}},
+		Labels:  []string{"foo"},
+	})
+	assert.Nil(t, err)
+
+	err = client.Add(prompb.TimeSeries{
+		Labels: labels,
+		Samples: []prompb.Sample{
+			{
+				Value:     1,
+				Timestamp: storageutils.Timestamp(now.Add(-15 * 24 * time.Hour)),
+			},
+			{
+				Value:     2,
+				Timestamp: storageutils.Timestamp(now.Add(-2 * StandardResolution)),
+			},
+			{
+				Value:     3,
+				Timestamp: storageutils.Timestamp(now),
+			},
+			{
+				Value:     4,
+				Timestamp: storageutils.Timestamp(now.Add(3 * time.Hour)),
+			},
+		},
+	})
+	assert.Nil(t, err)
+
+	// Samples outside of the window CloudWatch accepts are rejected, the rest are pushed for the period they were recorded.
+	batches := client.Flush()
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0].Data, 2)
+	assert.Equal(t, now.Add(-2*StandardResolution).Truncate(StandardResolution), batches[0].Data[0].Timestamp.Local())
+	assert.Equal(t, []*float64{aws.Float64(2)}, batches[0].Data[0].Values)
+	assert.Equal(t, now.Truncate(StandardResolution), batches[0].Data[1].Timestamp.Local())
+	assert.Equal(t, []*float64{aws.Float64(3)}, batches[0].Data[1].Values)
+}
+
+func TestStorageHighResolution(t *testing.T) {
+	now := time.Now()
+
+	client, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics: []Metric{{Name: "metric1", Resolution: 1}},
+		Labels:  []string{"foo"},
+	})
+	assert.Nil(t, err)
+
+	err = client.Add(prompb.TimeSeries{
+		Labels: []prompb.Label{
+			{
+				Name:  model.MetricNameLabel,
+				Value: "metric1",
+			},
+			{
+				Name:  "foo",
+				Value: "bar",
+			},
+		},
+		Samples: []prompb.Sample{
+			{
+				Value:     1,
+				Timestamp: storageutils.Timestamp(now.Add(-2 * time.Second)),
+			},
+			{
+				Value:     2,
+				Timestamp: storageutils.Timestamp(now),
+			},
+		},
+	})
+	assert.Nil(t, err)
+
+	// Samples are grouped per second rather than per minute.
+	batches := client.Flush()
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0].Data, 2)
+	assert.Equal(t, now.Add(-2*time.Second).Truncate(HighResolution), batches[0].Data[0].Timestamp.Local())
+	assert.Equal(t, aws.Int64(1), batches[0].Data[0].StorageResolution)
+	assert.Equal(t, now.Truncate(HighResolution), batches[0].Data[1].Timestamp.Local())
+	assert.Equal(t, aws.Int64(1), batches[0].Data[1].StorageResolution)
+}
+
+func TestStorageInvalidPattern(t *testing.T) {
+	_, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics: []Metric{{Name: "/node_(cpu/"}},
+		Labels:  []string{"foo"},
+	})
+	assert.Error(t, err)
+
+	_, err = New(mocklog.New(), "test", 10, Whitelist{
+		Metrics: []Metric{{Name: "node_*"}},
+		Labels:  []string{"foo_[ab"},
+	})
+	assert.Error(t, err)
+}
+
+func TestStoragePattern(t *testing.T) {
+	now := storageutils.Timestamp(time.Now())
+
+	client, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics: []Metric{{Name: "node_*"}},
+		Labels:  []string{"kubernetes_*"},
+	})
+	assert.Nil(t, err)
+
+	for _, name := range []string{"node_load1", "process_open_fds"} {
+		err = client.Add(prompb.TimeSeries{
+			Labels: []prompb.Label{
+				{Name: model.MetricNameLabel, Value: name},
+				{Name: "kubernetes_namespace", Value: "default"},
+				{Name: "instance", Value: "localhost"},
+			},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: now}},
+		})
+		assert.Nil(t, err)
+	}
+
+	batches := client.Flush()
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0].Data, 1)
+	assert.Equal(t, "node_load1", *batches[0].Data[0].MetricName)
+	assert.Equal(t, []*cloudwatch.Dimension{
+		{Name: aws.String("kubernetes_namespace"), Value: aws.String("default")},
+	}, batches[0].Data[0].Dimensions)
+}
+
+func TestStorageSelector(t *testing.T) {
+	now := storageutils.Timestamp(time.Now())
+
+	client, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics: []Metric{{Name: `http_requests_total{namespace=~"prod-.*",code!="200"}`}},
+		Labels:  []string{"namespace"},
+	})
+	assert.Nil(t, err)
+
+	for _, namespace := range []string{"prod-web", "dev"} {
+		for _, code := range []string{"200", "500"} {
+			err = client.Add(prompb.TimeSeries{
+				Labels: []prompb.Label{
+					{Name: model.MetricNameLabel, Value: "http_requests_total"},
+					{Name: "namespace", Value: namespace},
+					{Name: "code", Value: code},
+				},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: now}},
+			})
+			assert.Nil(t, err)
+		}
+	}
+
+	batches := client.Flush()
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0].Data, 1)
+	assert.Equal(t, "http_requests_total", *batches[0].Data[0].MetricName)
+	assert.Equal(t, "prod-web", *batches[0].Data[0].Dimensions[0].Value)
+}
+
+func TestStorageDeny(t *testing.T) {
+	now := storageutils.Timestamp(time.Now())
+
+	client, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics: []Metric{{Name: `{job="kube-state-metrics"}`}},
+		Labels:  []string{"namespace", "pod", "pod_ip"},
+		Deny: Deny{
+			Metrics:    []string{"kube_pod_container_*"},
+			Selectors:  []string{`{namespace="kube-system"}`},
+			Dimensions: []string{"pod*"},
+		},
+	})
+	assert.Nil(t, err)
+
+	var (
+		metrics    = counterValue(seriesDenied, denyMetrics, "kube_pod_container_*")
+		selectors  = counterValue(seriesDenied, denySelectors, `{namespace="kube-system"}`)
+		dimensions = counterValue(dimensionsDenied, "pod*")
+	)
+
+	for _, series := range [][]string{
+		{"kube_pod_info", "default"},
+		{"kube_pod_info", "kube-system"},
+		{"kube_pod_container_info", "default"},
+	} {
+		err = client.Add(prompb.TimeSeries{
+			Labels: []prompb.Label{
+				{Name: model.MetricNameLabel, Value: series[0]},
+				{Name: "job", Value: "kube-state-metrics"},
+				{Name: "namespace", Value: series[1]},
+				{Name: "pod", Value: "web-1"},
+				{Name: "pod_ip", Value: "10.0.0.1"},
+			},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: now}},
+		})
+		assert.Nil(t, err)
+	}
+
+	batches := client.Flush()
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0].Data, 1)
+	assert.Equal(t, "kube_pod_info", *batches[0].Data[0].MetricName)
+	assert.Equal(t, []*cloudwatch.Dimension{
+		{Name: aws.String("namespace"), Value: aws.String("default")},
+	}, batches[0].Data[0].Dimensions)
+
+	// Each series is counted once, even when a rule removes several of its dimensions.
+	assert.Equal(t, metrics+1, counterValue(seriesDenied, denyMetrics, "kube_pod_container_*"))
+	assert.Equal(t, selectors+1, counterValue(seriesDenied, denySelectors, `{namespace="kube-system"}`))
+	assert.Equal(t, dimensions+1, counterValue(dimensionsDenied, "pod*"))
+}
+
+func TestStorageDenyStrict(t *testing.T) {
+	whitelist := Whitelist{
+		Metrics: []Metric{{Name: "metric1", Dimensions: []string{"namespace", "pod"}, StrictDimensions: true}},
+		Deny:    Deny{Dimensions: []string{"pod*"}},
+	}
+
+	// A metric with strict dimensions could not be published with exactly its dimensions.
+	_, err := New(mocklog.New(), "test", 10, whitelist)
+	assert.EqualError(t, err, "strict dimension of metric1 is denied by pod*: pod")
+
+	whitelist.Metrics[0].StrictDimensions = false
+
+	_, err = New(mocklog.New(), "test", 10, whitelist)
+	assert.Nil(t, err)
+}
+
+// Value of a counter with the given labels.
+func counterValue(counter *prometheus.CounterVec, labels ...string) float64 {
+	var metric dto.Metric
+
+	if err := counter.WithLabelValues(labels...).Write(&metric); err != nil {
+		panic(err)
+	}
+
+	return metric.GetCounter().GetValue()
+}
+
+func TestStorageRelabel(t *testing.T) {
+	now := storageutils.Timestamp(time.Now())
+
+	rename := relabel.DefaultConfig
+	rename.SourceLabels = []string{"kubernetes_namespace"}
+	rename.TargetLabel = "Namespace"
+
+	drop := relabel.DefaultConfig
+	drop.SourceLabels = []string{"Namespace"}
+	drop.Regex = relabel.MustNewRegexp("dev")
+	drop.Action = relabel.Drop
+
+	client, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics:        []Metric{{Name: "metric1"}},
+		Labels:         []string{"Namespace"},
+		RelabelConfigs: []*relabel.Config{&rename, &drop},
+	})
+	assert.Nil(t, err)
+
+	for _, namespace := range []string{"prod", "dev"} {
+		err = client.Add(prompb.TimeSeries{
+			Labels: []prompb.Label{
+				{Name: model.MetricNameLabel, Value: "metric1"},
+				{Name: "kubernetes_namespace", Value: namespace},
+			},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: now}},
+		})
+		assert.Nil(t, err)
+	}
+
+	batches := client.Flush()
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0].Data, 1)
+	assert.Equal(t, []*cloudwatch.Dimension{
+		{Name: aws.String("Namespace"), Value: aws.String("prod")},
+	}, batches[0].Data[0].Dimensions)
+
+	// The labels of the series are kept as they were received.
+	assert.Equal(t, [][]Labels{
+		{{model.MetricNameLabel: "metric1", "kubernetes_namespace": "prod"}},
+	}, batches[0].Labels)
+}
+
+func TestStorageMetricDimensions(t *testing.T) {
+	now := storageutils.Timestamp(time.Now())
+
+	client, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics: []Metric{
+			{Name: "metric1", Dimensions: []string{"namespace"}},
+			{Name: "metric2", Dimensions: []string{"namespace", "pod"}, StrictDimensions: true},
+			{Name: "metric3"},
+		},
+		Labels: []string{"namespace", "pod"},
+	})
+	assert.Nil(t, err)
+
+	for _, labels := range [][]prompb.Label{
+		{{Name: model.MetricNameLabel, Value: "metric1"}, {Name: "namespace", Value: "default"}, {Name: "pod", Value: "web-1"}},
+		{{Name: model.MetricNameLabel, Value: "metric2"}, {Name: "namespace", Value: "default"}, {Name: "pod", Value: "web-1"}},
+		{{Name: model.MetricNameLabel, Value: "metric2"}, {Name: "namespace", Value: "other"}},
+		{{Name: model.MetricNameLabel, Value: "metric3"}, {Name: "namespace", Value: "default"}, {Name: "pod", Value: "web-1"}},
+	} {
+		err = client.Add(prompb.TimeSeries{
+			Labels:  labels,
+			Samples: []prompb.Sample{{Value: 1, Timestamp: now}},
+		})
+		assert.Nil(t, err)
+	}
+
+	batches := client.Flush()
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0].Data, 3)
+
+	// Rule dimensions replace the global list and series missing a strict dimension are dropped.
+	for i, want := range []int{1, 2, 2} {
+		assert.Len(t, batches[0].Data[i].Dimensions, want)
+	}
+
+	assert.Equal(t, "metric2", *batches[0].Data[1].MetricName)
+	assert.Equal(t, "default", *batches[0].Data[1].Dimensions[0].Value)
+}
+
+func TestStorageReplay(t *testing.T) {
+	client, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics:    []Metric{{Name: "metric1"}},
+		Labels:     []string{"foo"},
+		Validation: Validation{NameLength: ActionDrop},
+	})
+	assert.Nil(t, err)
+
+	labels := []Labels{{model.MetricNameLabel: "metric1", "foo": "bar"}}
+
+	batches := client.Replay([]DeadLetterEntry{
+		{
+			Namespace: "test",
+			Datum:     &cloudwatch.MetricDatum{MetricName: aws.String("metric1"), Values: []*float64{aws.Float64(1)}},
+			Labels:    labels,
+		},
+		{
+			Namespace: "other",
+			Datum:     &cloudwatch.MetricDatum{MetricName: aws.String("metric1"), Values: []*float64{aws.Float64(2)}},
+		},
+		{
+			// Dropped by the validation rules.
+			Namespace: "test",
+			Datum:     &cloudwatch.MetricDatum{MetricName: aws.String(strings.Repeat("x", MaxNameLength+1)), Values: []*float64{aws.Float64(3)}},
+		},
+	})
+
+	assert.Len(t, batches, 2)
+	assert.Equal(t, "other", batches[0].Namespace)
+	assert.Equal(t, "test", batches[1].Namespace)
+	assert.Len(t, batches[1].Data, 1)
+	assert.Equal(t, [][]Labels{labels}, batches[1].Labels)
 }
@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+
+	storageutils "github.com/skpr/prometheus-cloudwatch/internal/storage/utils"
+)
+
+// Increase of the _sum and _count series of a summary within a single period.
+type summary struct {
+	name       *string
+	dimensions []*cloudwatch.Dimension
+	timestamp  *time.Time
+	unit       string
+	resolution *int64
+	sum        float64
+	count      float64
+	// Minimum and maximum observations from the 0 and 1 quantiles, when the summary exposes them.
+	minimum *float64
+	maximum *float64
+	sources sources
+}
+
+// Adds a series which belongs to a summary family. Quantiles are pushed as gauges, either as their own metric
+// (eg. name_p99) or with a "quantile" dimension. The _sum and _count series are converted to the increase since the
+// previous sample and pushed together, as a StatisticSet when the 0 and 1 quantiles provide the minimum and maximum.
+func (c *Client) addSummary(ts prompb.TimeSeries, rule Metric, suffix string, now time.Time) error {
+	if suffix == suffixSum || suffix == suffixCount {
+		return c.addSummaryTotal(ts, rule, suffix, now)
+	}
+
+	var (
+		quantile float64
+		found    bool
+		labels   []prompb.Label
+	)
+
+	for _, label := range ts.Labels {
+		if label.Name != model.QuantileLabel {
+			labels = append(labels, label)
+			continue
+		}
+
+		value, err := strconv.ParseFloat(label.Value, 64)
+		if err != nil {
+			break
+		}
+
+		quantile, found = value, true
+	}
+
+	if !found {
+		c.logger.Infof("Skipping because summary has an invalid quantile: %s", rule.Name)
+		samplesDropped.WithLabelValues(reasonInvalid).Add(float64(len(ts.Samples)))
+		return nil
+	}
+
+	// Dimensions are resolved without the quantile label, so it is only added once when it is a dimension.
+	names := c.dimensions(rule, labels)
+
+	if quantile == 0 || quantile == 1 {
+		c.addSummaryBound(prompb.TimeSeries{Labels: labels, Samples: ts.Samples}, names, rule, quantile, now)
+	}
+
+	if len(rule.Quantiles) > 0 && !containsFloat(rule.Quantiles, quantile) {
+		samplesDropped.WithLabelValues(reasonWhitelist).Add(float64(len(ts.Samples)))
+		return nil
+	}
+
+	unit := c.unit(rule.Name, rule)
+
+	if rule.QuantileDimension {
+		return c.addSeries(ts, rule, unit, append([]string{model.QuantileLabel}, names...), now)
+	}
+
+	unit.name = QuantileName(unit.name, quantile)
+
+	return c.addSeries(prompb.TimeSeries{Labels: labels, Samples: ts.Samples}, rule, unit, names, now)
+}
+
+// Adds the 0 or 1 quantile of a summary, without its quantile label, as the minimum or maximum observation of the period.
+func (c *Client) addSummaryBound(ts prompb.TimeSeries, names []string, rule Metric, quantile float64, now time.Time) {
+	dimensions := c.withStatic(storageutils.Dimensions(ts.Labels, names), ts.Labels)
+	if len(dimensions) == 0 && !c.allowNoDimensions(rule) {
+		return
+	}
+
+	unit := c.unit(rule.Name, rule)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, sample := range ts.Samples {
+		if math.IsNaN(sample.Value) {
+			continue
+		}
+
+		timestamp := storageutils.Time(sample.Timestamp).Truncate(rule.period())
+
+		if !accepted(timestamp, now, 1) {
+			continue
+		}
+
+		var (
+			s     = c.summary(rule, unit, dimensions, timestamp)
+			value = sample.Value * unit.scale
+		)
+
+		if quantile == 0 {
+			if s.minimum == nil || value < *s.minimum {
+				s.minimum = aws.Float64(value)
+			}
+
+			continue
+		}
+
+		if s.maximum == nil || value > *s.maximum {
+			s.maximum = aws.Float64(value)
+		}
+	}
+}
+
+// Adds the increase of the _sum or _count series of a summary.
+func (c *Client) addSummaryTotal(ts prompb.TimeSeries, rule Metric, suffix string, now time.Time) error {
+	dimensions := c.withStatic(storageutils.Dimensions(ts.Labels, c.dimensions(rule, ts.Labels)), ts.Labels)
+	if len(dimensions) == 0 && !c.allowNoDimensions(rule) {
+		c.logger.Infof("Skipping because no dimensions were found: %s", rule.Name)
+		samplesDropped.WithLabelValues(reasonDimensions).Add(float64(len(ts.Samples)))
+		return nil
+	}
+
+	var (
+		unit   = c.unit(rule.Name, rule)
+		source = storageutils.LabelsKey(rule.labels)
+	)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, sample := range c.convertCounter(ts, CounterDelta, now).Samples {
+		if math.IsNaN(sample.Value) {
+			samplesDropped.WithLabelValues(nanReason(sample.Value)).Inc()
+			continue
+		}
+
+		timestamp := storageutils.Time(sample.Timestamp).Truncate(rule.period())
+
+		if !accepted(timestamp, now, 1) {
+			continue
+		}
+
+		s := c.summary(rule, unit, dimensions, timestamp)
+
+		if suffix == suffixSum {
+			s.sum += sample.Value * unit.scale
+		} else {
+			s.count += sample.Value
+		}
+
+		s.sources.add(source, rule.labels)
+	}
+
+	return nil
+}
+
+// Summary for a single period, which is created if it has not been seen. Must be called while holding the mutex.
+func (c *Client) summary(rule Metric, unit metricUnit, dimensions []*cloudwatch.Dimension, timestamp time.Time) *summary {
+	metric := &cloudwatch.MetricDatum{
+		MetricName: aws.String(unit.name),
+		Dimensions: dimensions,
+		Timestamp:  aws.Time(timestamp),
+	}
+
+	key := datumKey(rule.namespace, metric)
+
+	s, ok := c.summaries[key]
+	if !ok {
+		s = &summary{
+			name:       metric.MetricName,
+			dimensions: metric.Dimensions,
+			timestamp:  metric.Timestamp,
+			unit:       unit.unit,
+			resolution: rule.storageResolution(),
+		}
+
+		c.summaries[key] = s
+	}
+
+	return s
+}
+
+// Builds a datum from the increase of the _sum and _count series. A summary only exposes the minimum and maximum
+// observation through the 0 and 1 quantiles, so without them the average is pushed as a value with the number of
+// observations instead of inventing a StatisticSet.
+func (s *summary) datum() *cloudwatch.MetricDatum {
+	if s.count <= 0 {
+		return nil
+	}
+
+	var (
+		average = s.sum / s.count
+		datum   = &cloudwatch.MetricDatum{
+			MetricName:        s.name,
+			Dimensions:        s.dimensions,
+			Timestamp:         s.timestamp,
+			Unit:              aws.String(s.unit),
+			StorageResolution: s.resolution,
+		}
+	)
+
+	if s.minimum == nil || s.maximum == nil {
+		datum.Values = []*float64{aws.Float64(average)}
+		datum.Counts = []*float64{aws.Float64(s.count)}
+		return datum
+	}
+
+	// The quantiles cover the window of the summary rather than the period, so they are widened to include the average.
+	datum.StatisticValues = &cloudwatch.StatisticSet{
+		Minimum:     aws.Float64(math.Min(*s.minimum, average)),
+		Maximum:     aws.Float64(math.Max(*s.maximum, average)),
+		Sum:         aws.Float64(s.sum),
+		SampleCount: aws.Float64(s.count),
+	}
+
+	return datum
+}
+
+// QuantileName of the metric a summary quantile is pushed as eg. 0.99 is pushed as name_p99.
+func QuantileName(name string, quantile float64) string {
+	// Rounded to avoid floating point noise eg. 0.29 * 100 = 28.999999999999996.
+	return name + "_p" + strconv.FormatFloat(math.Round(quantile*1e8)/1e6, 'f', -1, 64)
+}
+
+// Reports whether a float is within a slice.
+func containsFloat(s []float64, e float64) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+
+	mocklog "github.com/skpr/prometheus-cloudwatch/internal/storage/mock/log"
+	storageutils "github.com/skpr/prometheus-cloudwatch/internal/storage/utils"
+)
+
+func TestSummary(t *testing.T) {
+	client, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics: []Metric{
+			{
+				Name:      "request_duration",
+				Type:      TypeSummary,
+				Quantiles: []float64{0.99},
+			},
+		},
+		Labels: []string{"foo"},
+	})
+	assert.Nil(t, err)
+
+	now := storageutils.Timestamp(client.(*Client).now().Truncate(StandardResolution))
+
+	series := func(name, quantile string, value float64, timestamp int64) prompb.TimeSeries {
+		ts := prompb.TimeSeries{
+			Labels: []prompb.Label{
+				{
+					Name:  model.MetricNameLabel,
+					Value: name,
+				},
+				{
+					Name:  "foo",
+					Value: "bar",
+				},
+			},
+			Samples: []prompb.Sample{
+				{
+					Value:     value,
+					Timestamp: timestamp,
+				},
+			},
+		}
+
+		if quantile != "" {
+			ts.Labels = append(ts.Labels, prompb.Label{Name: model.QuantileLabel, Value: quantile})
+		}
+
+		return ts
+	}
+
+	for _, ts := range []prompb.TimeSeries{
+		series("request_duration", "0.5", 0.2, now),
+		series("request_duration", "0.99", 0.8, now),
+		series("request_duration_sum", "", 10, now),
+		series("request_duration_count", "", 20, now),
+		series("request_duration_sum", "", 16, now+10000),
+		series("request_duration_count", "", 30, now+10000),
+	} {
+		assert.Nil(t, client.Add(ts))
+	}
+
+	batches := client.Flush()
+	assert.Len(t, batches, 1)
+
+	dimensions := []*cloudwatch.Dimension{
+		{
+			Name:  aws.String("foo"),
+			Value: aws.String("bar"),
+		},
+	}
+
+	want := []*cloudwatch.MetricDatum{
+		{
+			MetricName: aws.String("request_duration_p99"),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(storageutils.Time(now)),
+			Unit:       aws.String(cloudwatch.StandardUnitNone),
+			Values:     []*float64{aws.Float64(0.8)},
+			Counts:     []*float64{aws.Float64(1)},
+		},
+		{
+			MetricName: aws.String("request_duration"),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(storageutils.Time(now)),
+			Unit:       aws.String(cloudwatch.StandardUnitNone),
+			// Without the 0 and 1 quantiles the average is pushed with the number of observations.
+			Values: []*float64{aws.Float64(0.6)},
+			Counts: []*float64{aws.Float64(10)},
+		},
+	}
+
+	assert.Equal(t, want, batches[0].Data)
+}
+
+func TestSummaryBounds(t *testing.T) {
+	client, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics: []Metric{
+			{
+				Name:      "request_duration",
+				Type:      TypeSummary,
+				Quantiles: []float64{0.99},
+			},
+		},
+		Labels: []string{"foo"},
+	})
+	assert.Nil(t, err)
+
+	now := storageutils.Timestamp(client.(*Client).now().Truncate(StandardResolution))
+
+	series := func(name string, labels []prompb.Label, value float64, timestamp int64) prompb.TimeSeries {
+		return prompb.TimeSeries{
+			Labels:  append([]prompb.Label{{Name: model.MetricNameLabel, Value: name}, {Name: "foo", Value: "bar"}}, labels...),
+			Samples: []prompb.Sample{{Value: value, Timestamp: timestamp}},
+		}
+	}
+
+	quantile := func(value string) []prompb.Label {
+		return []prompb.Label{{Name: model.QuantileLabel, Value: value}}
+	}
+
+	for _, ts := range []prompb.TimeSeries{
+		series("request_duration", quantile("0"), 0.1, now),
+		series("request_duration", quantile("0"), 0.05, now+10000),
+		series("request_duration", quantile("1"), 2, now),
+		series("request_duration_sum", nil, 10, now),
+		series("request_duration_count", nil, 20, now),
+		series("request_duration_sum", nil, 16, now+10000),
+		series("request_duration_count", nil, 30, now+10000),
+	} {
+		assert.Nil(t, client.Add(ts))
+	}
+
+	batches := client.Flush()
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0].Data, 1)
+
+	// The 0 and 1 quantiles are the minimum and maximum, even though they have not been whitelisted.
+	assert.Equal(t, &cloudwatch.StatisticSet{
+		Minimum:     aws.Float64(0.05),
+		Maximum:     aws.Float64(2),
+		Sum:         aws.Float64(6),
+		SampleCount: aws.Float64(10),
+	}, batches[0].Data[0].StatisticValues)
+}
+
+func TestSummaryQuantileDimension(t *testing.T) {
+	client, err := New(mocklog.New(), "test", 10, Whitelist{
+		Metrics: []Metric{
+			{
+				Name:              "request_duration",
+				Type:              TypeSummary,
+				QuantileDimension: true,
+			},
+		},
+		Labels: []string{"foo", model.QuantileLabel},
+	})
+	assert.Nil(t, err)
+
+	err = client.Add(prompb.TimeSeries{
+		Labels: []prompb.Label{
+			{Name: model.MetricNameLabel, Value: "request_duration"},
+			{Name: "foo", Value: "bar"},
+			{Name: model.QuantileLabel, Value: "0.99"},
+		},
+		Samples: []prompb.Sample{{Value: 0.8, Timestamp: storageutils.Timestamp(client.(*Client).now())}},
+	})
+	assert.Nil(t, err)
+
+	batches := client.Flush()
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0].Data, 1)
+
+	// The quantile is only added once when it is also a whitelisted label.
+	assert.Equal(t, []*cloudwatch.Dimension{
+		{Name: aws.String("foo"), Value: aws.String("bar")},
+		{Name: aws.String(model.QuantileLabel), Value: aws.String("0.99")},
+	}, batches[0].Data[0].Dimensions)
+}
+
+func TestQuantileName(t *testing.T) {
+	assert.Equal(t, "latency_p50", QuantileName("latency", 0.5))
+	assert.Equal(t, "latency_p99", QuantileName("latency", 0.99))
+	assert.Equal(t, "latency_p99.9", QuantileName("latency", 0.999))
+	assert.Equal(t, "latency_p29", QuantileName("latency", 0.29))
+}
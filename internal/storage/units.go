@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// Ratios do not have a CloudWatch unit, but can be converted to a percentage.
+const unitRatio = "ratio"
+
+// Unit family and size relative to the base unit of the family, used to convert values between units.
+type unit struct {
+	family string
+	factor float64
+}
+
+// Units which CloudWatch accepts.
+var units = map[string]unit{
+	cloudwatch.StandardUnitSeconds:         {"time", 1},
+	cloudwatch.StandardUnitMilliseconds:    {"time", 1e-3},
+	cloudwatch.StandardUnitMicroseconds:    {"time", 1e-6},
+	cloudwatch.StandardUnitBytes:           {"bytes", 1},
+	cloudwatch.StandardUnitKilobytes:       {"bytes", 1 << 10},
+	cloudwatch.StandardUnitMegabytes:       {"bytes", 1 << 20},
+	cloudwatch.StandardUnitGigabytes:       {"bytes", 1 << 30},
+	cloudwatch.StandardUnitTerabytes:       {"bytes", 1 << 40},
+	cloudwatch.StandardUnitBits:            {"bits", 1},
+	cloudwatch.StandardUnitKilobits:        {"bits", 1 << 10},
+	cloudwatch.StandardUnitMegabits:        {"bits", 1 << 20},
+	cloudwatch.StandardUnitGigabits:        {"bits", 1 << 30},
+	cloudwatch.StandardUnitTerabits:        {"bits", 1 << 40},
+	cloudwatch.StandardUnitBytesSecond:     {"bytes/s", 1},
+	cloudwatch.StandardUnitKilobytesSecond: {"bytes/s", 1 << 10},
+	cloudwatch.StandardUnitMegabytesSecond: {"bytes/s", 1 << 20},
+	cloudwatch.StandardUnitGigabytesSecond: {"bytes/s", 1 << 30},
+	cloudwatch.StandardUnitTerabytesSecond: {"bytes/s", 1 << 40},
+	cloudwatch.StandardUnitBitsSecond:      {"bits/s", 1},
+	cloudwatch.StandardUnitKilobitsSecond:  {"bits/s", 1 << 10},
+	cloudwatch.StandardUnitMegabitsSecond:  {"bits/s", 1 << 20},
+	cloudwatch.StandardUnitGigabitsSecond:  {"bits/s", 1 << 30},
+	cloudwatch.StandardUnitTerabitsSecond:  {"bits/s", 1 << 40},
+	cloudwatch.StandardUnitPercent:         {"ratio", 1e-2},
+	cloudwatch.StandardUnitCount:           {"count", 1},
+	cloudwatch.StandardUnitCountSecond:     {"count/s", 1},
+	cloudwatch.StandardUnitNone:            {"none", 1},
+	unitRatio:                              {"ratio", 1},
+}
+
+// Units inferred from the suffix of a metric name, following the Prometheus naming conventions.
+var unitSuffixes = []struct {
+	suffix string
+	unit   string
+}{
+	{"_seconds", cloudwatch.StandardUnitSeconds},
+	{"_milliseconds", cloudwatch.StandardUnitMilliseconds},
+	{"_microseconds", cloudwatch.StandardUnitMicroseconds},
+	{"_bytes", cloudwatch.StandardUnitBytes},
+	{"_bits", cloudwatch.StandardUnitBits},
+	{"_percent", cloudwatch.StandardUnitPercent},
+	{"_ratio", unitRatio},
+}
+
+// Units which have a per second equivalent when a counter is converted to a rate.
+var unitRates = map[string]string{
+	cloudwatch.StandardUnitBytes: cloudwatch.StandardUnitBytesSecond,
+	cloudwatch.StandardUnitBits:  cloudwatch.StandardUnitBitsSecond,
+	cloudwatch.StandardUnitCount: cloudwatch.StandardUnitCountSecond,
+}
+
+// Unit which a metric is pushed with, including the name once the unit suffix has optionally been stripped.
+type metricUnit struct {
+	name string
+	unit string
+	// Values are multiplied by the scale to convert them to the unit.
+	scale float64
+}
+
+// Resolves the unit for a metric. The unit is inferred from the name, eg. _seconds, _bytes or _total, unless it has
+// been set for the metric. Values are converted when the unit which was set is in the same family as the one inferred
+// eg. seconds to milliseconds.
+func resolveUnit(name string, rule Metric, strip bool) metricUnit {
+	var (
+		base     = strings.TrimSuffix(name, "_total")
+		suffix   string
+		inferred string
+	)
+
+	for _, s := range unitSuffixes {
+		if strings.HasSuffix(base, s.suffix) {
+			suffix, inferred = s.suffix, s.unit
+			break
+		}
+	}
+
+	if base != name {
+		suffix = name[len(base)-len(suffix):]
+
+		if inferred == "" {
+			inferred = cloudwatch.StandardUnitCount
+		}
+	}
+
+	if rule.Counter == CounterRate {
+		inferred = unitRates[inferred]
+	}
+
+	resolved := metricUnit{
+		name:  name,
+		unit:  inferred,
+		scale: 1,
+	}
+
+	if rule.Unit != "" {
+		resolved.unit = rule.Unit
+
+		from, fromOK := units[inferred]
+		to, toOK := units[rule.Unit]
+
+		if fromOK && toOK && from.family == to.family {
+			resolved.scale = from.factor / to.factor
+		}
+	}
+
+	if resolved.unit == "" || resolved.unit == unitRatio {
+		resolved.unit = cloudwatch.StandardUnitNone
+	}
+
+	if (strip || rule.StripUnitSuffix) && suffix != "" && len(suffix) < len(name) {
+		resolved.name = strings.TrimSuffix(name, suffix)
+	}
+
+	return resolved
+}
+
+// Validates a unit which has been set for a metric.
+func validateUnit(name string) error {
+	if _, ok := units[name]; !ok || name == unitRatio {
+		return fmt.Errorf("unit not supported: %s", name)
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveUnit(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  Metric
+		strip bool
+		want  metricUnit
+	}{
+		{
+			name: "http_request_duration_seconds",
+			want: metricUnit{"http_request_duration_seconds", cloudwatch.StandardUnitSeconds, 1},
+		},
+		{
+			name: "http_request_duration_seconds",
+			rule: Metric{Unit: cloudwatch.StandardUnitMilliseconds},
+			want: metricUnit{"http_request_duration_seconds", cloudwatch.StandardUnitMilliseconds, 1000},
+		},
+		{
+			name:  "node_memory_available_bytes",
+			strip: true,
+			want:  metricUnit{"node_memory_available", cloudwatch.StandardUnitBytes, 1},
+		},
+		{
+			name: "node_network_receive_bytes_total",
+			rule: Metric{Counter: CounterRate, StripUnitSuffix: true},
+			want: metricUnit{"node_network_receive", cloudwatch.StandardUnitBytesSecond, 1},
+		},
+		{
+			name: "http_requests_total",
+			want: metricUnit{"http_requests_total", cloudwatch.StandardUnitCount, 1},
+		},
+		{
+			name: "http_requests_total",
+			rule: Metric{Counter: CounterRate},
+			want: metricUnit{"http_requests_total", cloudwatch.StandardUnitCountSecond, 1},
+		},
+		{
+			name: "cache_hit_ratio",
+			want: metricUnit{"cache_hit_ratio", cloudwatch.StandardUnitNone, 1},
+		},
+		{
+			name: "cache_hit_ratio",
+			rule: Metric{Unit: cloudwatch.StandardUnitPercent},
+			want: metricUnit{"cache_hit_ratio", cloudwatch.StandardUnitPercent, 100},
+		},
+		{
+			name:  "up",
+			strip: true,
+			want:  metricUnit{"up", cloudwatch.StandardUnitNone, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, resolveUnit(tt.name, tt.rule, tt.strip), tt.name)
+	}
+}
+
+func TestValidateUnit(t *testing.T) {
+	assert.Nil(t, validateUnit(cloudwatch.StandardUnitMilliseconds))
+	assert.NotNil(t, validateUnit("Fortnights"))
+	assert.NotNil(t, validateUnit(unitRatio))
+}
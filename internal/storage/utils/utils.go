@@ -2,6 +2,10 @@ package utils
 
 import (
 	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
@@ -9,31 +13,181 @@ import (
 	"github.com/prometheus/prometheus/prompb"
 )
 
-// TimeSeriesToCloudWatch converts a Prometheus TimeSeries to a CloudWatch MetricDatum.
-func TimeSeriesToCloudWatch(ts prompb.TimeSeries, dimensions []string) (*cloudwatch.MetricDatum, error) {
-	metric := &cloudwatch.MetricDatum{}
+// TimeSeriesToCloudWatch converts a Prometheus TimeSeries to CloudWatch MetricDatums.
+// Samples are grouped into one datum for each period they fall within, with the timestamp set to the start of the period.
+func TimeSeriesToCloudWatch(ts prompb.TimeSeries, dimensions []string, period time.Duration) ([]*cloudwatch.MetricDatum, error) {
+	var (
+		name    *string
+		dims    = Dimensions(ts.Labels, dimensions)
+		metrics []*cloudwatch.MetricDatum
+		periods = make(map[int64]*cloudwatch.MetricDatum)
+	)
 
-	for _, label := range ts.Labels {
-		if label.Name == model.MetricNameLabel {
-			metric.MetricName = aws.String(label.Value)
+	if value := MetricName(ts.Labels); value != "" {
+		name = aws.String(value)
+	}
+
+	for _, sample := range ts.Samples {
+		if math.IsNaN(sample.Value) {
+			continue
+		}
+
+		timestamp := Time(sample.Timestamp).Truncate(period)
+
+		metric, ok := periods[timestamp.UnixNano()]
+		if !ok {
+			metric = &cloudwatch.MetricDatum{
+				MetricName: name,
+				Dimensions: dims,
+				Timestamp:  aws.Time(timestamp),
+			}
+
+			periods[timestamp.UnixNano()] = metric
+			metrics = append(metrics, metric)
+		}
+
+		metric.Values = append(metric.Values, aws.Float64(sample.Value))
+	}
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Timestamp.Before(*metrics[j].Timestamp)
+	})
+
+	return metrics, nil
+}
+
+// Dimensions for the labels which have been whitelisted. Labels with the reserved __ prefix eg. __name__ are never
+// used as dimensions.
+func Dimensions(labels []prompb.Label, dimensions []string) []*cloudwatch.Dimension {
+	var dims []*cloudwatch.Dimension
+
+	for _, label := range labels {
+		if strings.HasPrefix(label.Name, model.ReservedLabelPrefix) {
 			continue
 		}
 
 		if Contains(dimensions, label.Name) {
-			metric.Dimensions = append(metric.Dimensions, &cloudwatch.Dimension{
+			dims = append(dims, &cloudwatch.Dimension{
 				Name:  aws.String(label.Name),
 				Value: aws.String(label.Value),
 			})
 		}
 	}
 
-	for _, sample := range ts.Samples {
-		if !math.IsNaN(sample.Value) {
-			metric.Values = append(metric.Values, aws.Float64(sample.Value))
+	return dims
+}
+
+// MetricName of a Prometheus TimeSeries.
+func MetricName(labels []prompb.Label) string {
+	for _, label := range labels {
+		if label.Name == model.MetricNameLabel {
+			return label.Value
 		}
 	}
 
-	return metric, nil
+	return ""
+}
+
+// LabelsKey which uniquely identifies a Prometheus series by all of its labels.
+func LabelsKey(labels []prompb.Label) string {
+	pairs := make([]string, len(labels))
+
+	for i, label := range labels {
+		pairs[i] = label.Name + "=" + strconv.Quote(label.Value)
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// Time converts a Prometheus timestamp in milliseconds to a time.
+func Time(timestamp int64) time.Time {
+	return time.Unix(0, timestamp*int64(time.Millisecond)).UTC()
+}
+
+// Timestamp converts a time to a Prometheus timestamp in milliseconds.
+func Timestamp(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Key which uniquely identifies the series and period a MetricDatum belongs to. Dimension names and values are quoted
+// like LabelsKey, because unlike Prometheus labels they can contain any character eg. "=" or ",".
+func Key(metric *cloudwatch.MetricDatum) string {
+	var dimensions []string
+
+	for _, dimension := range metric.Dimensions {
+		var (
+			name  = strconv.Quote(aws.StringValue(dimension.Name))
+			value = strconv.Quote(aws.StringValue(dimension.Value))
+		)
+
+		dimensions = append(dimensions, name+"="+value)
+	}
+
+	sort.Strings(dimensions)
+
+	key := aws.StringValue(metric.MetricName) + "{" + strings.Join(dimensions, ",") + "}"
+
+	if metric.Timestamp != nil {
+		key += "@" + strconv.FormatInt(metric.Timestamp.Unix(), 10)
+	}
+
+	return key
+}
+
+// ValuesCounts collapses a list of samples into unique values and the number of times each occurred.
+func ValuesCounts(samples []float64) ([]*float64, []*float64) {
+	counts := make(map[float64]float64)
+
+	for _, sample := range samples {
+		counts[sample]++
+	}
+
+	unique := make([]float64, 0, len(counts))
+	for value := range counts {
+		unique = append(unique, value)
+	}
+
+	sort.Float64s(unique)
+
+	var (
+		values = make([]*float64, len(unique))
+		totals = make([]*float64, len(unique))
+	)
+
+	for i, value := range unique {
+		values[i] = aws.Float64(value)
+		totals[i] = aws.Float64(counts[value])
+	}
+
+	return values, totals
+}
+
+// StatisticSet which summarises a list of samples.
+func StatisticSet(samples []float64) *cloudwatch.StatisticSet {
+	if len(samples) == 0 {
+		return nil
+	}
+
+	var (
+		min = samples[0]
+		max = samples[0]
+		sum float64
+	)
+
+	for _, sample := range samples {
+		min = math.Min(min, sample)
+		max = math.Max(max, sample)
+		sum += sample
+	}
+
+	return &cloudwatch.StatisticSet{
+		Minimum:     aws.Float64(min),
+		Maximum:     aws.Float64(max),
+		Sum:         aws.Float64(sum),
+		SampleCount: aws.Float64(float64(len(samples))),
+	}
 }
 
 // Contains a string within a slice.
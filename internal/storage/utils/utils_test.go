@@ -1,7 +1,9 @@
 package utils
 
 import (
+	"math"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
@@ -36,13 +38,20 @@ func TestTimeSeriesToCloudWatch(t *testing.T) {
 		},
 		Samples: []prompb.Sample{
 			{
-				Value: 1,
+				Value:     1,
+				Timestamp: 60000,
 			},
 			{
-				Value: 2,
+				Value:     2,
+				Timestamp: 90000,
 			},
 			{
-				Value: 3,
+				Value:     3,
+				Timestamp: 120000,
+			},
+			{
+				Value:     math.NaN(),
+				Timestamp: 120000,
 			},
 		},
 	}
@@ -53,31 +62,93 @@ func TestTimeSeriesToCloudWatch(t *testing.T) {
 		"container",
 	}
 
-	metric, err := TimeSeriesToCloudWatch(ts, labels)
+	metrics, err := TimeSeriesToCloudWatch(ts, labels, time.Minute)
 	assert.Nil(t, err)
 
-	want := &cloudwatch.MetricDatum{
+	dimensions := []*cloudwatch.Dimension{
+		{
+			Name:  aws.String("namespace"),
+			Value: aws.String("test"),
+		},
+		{
+			Name:  aws.String("pod"),
+			Value: aws.String("test"),
+		},
+		{
+			Name:  aws.String("container"),
+			Value: aws.String("test"),
+		},
+	}
+
+	want := []*cloudwatch.MetricDatum{
+		{
+			MetricName: aws.String("test"),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(time.Unix(60, 0).UTC()),
+			Values: []*float64{
+				aws.Float64(1),
+				aws.Float64(2),
+			},
+		},
+		{
+			MetricName: aws.String("test"),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(time.Unix(120, 0).UTC()),
+			Values: []*float64{
+				aws.Float64(3),
+			},
+		},
+	}
+
+	assert.Equal(t, want, metrics)
+}
+
+func TestKey(t *testing.T) {
+	a := &cloudwatch.MetricDatum{
 		MetricName: aws.String("test"),
 		Dimensions: []*cloudwatch.Dimension{
-			{
-				Name:  aws.String("namespace"),
-				Value: aws.String("test"),
-			},
 			{
 				Name:  aws.String("pod"),
-				Value: aws.String("test"),
+				Value: aws.String("foo"),
 			},
 			{
-				Name:  aws.String("container"),
-				Value: aws.String("test"),
+				Name:  aws.String("namespace"),
+				Value: aws.String("bar"),
 			},
 		},
-		Values: []*float64{
-			aws.Float64(1),
-			aws.Float64(2),
-			aws.Float64(3),
-		},
 	}
 
-	assert.Equal(t, want, metric)
+	b := &cloudwatch.MetricDatum{
+		MetricName: aws.String("test"),
+		Dimensions: []*cloudwatch.Dimension{a.Dimensions[1], a.Dimensions[0]},
+	}
+
+	assert.Equal(t, `test{"namespace"="bar","pod"="foo"}`, Key(a))
+	assert.Equal(t, Key(a), Key(b))
+
+	// Values which contain separators do not collide with other dimensions.
+	c := &cloudwatch.MetricDatum{
+		MetricName: aws.String("test"),
+		Dimensions: []*cloudwatch.Dimension{{Name: aws.String("namespace"), Value: aws.String("bar,pod=foo")}},
+	}
+
+	assert.NotEqual(t, Key(a), Key(c))
+}
+
+func TestValuesCounts(t *testing.T) {
+	values, counts := ValuesCounts([]float64{3, 1, 3, 2, 3})
+	assert.Equal(t, []*float64{aws.Float64(1), aws.Float64(2), aws.Float64(3)}, values)
+	assert.Equal(t, []*float64{aws.Float64(1), aws.Float64(1), aws.Float64(3)}, counts)
+}
+
+func TestStatisticSet(t *testing.T) {
+	want := &cloudwatch.StatisticSet{
+		Minimum:     aws.Float64(1),
+		Maximum:     aws.Float64(4),
+		Sum:         aws.Float64(7),
+		SampleCount: aws.Float64(3),
+	}
+
+	assert.Equal(t, want, StatisticSet([]float64{2, 1, 4}))
+	assert.Nil(t, StatisticSet(nil))
 }
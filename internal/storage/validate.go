@@ -0,0 +1,329 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+
+	storageutils "github.com/skpr/prometheus-cloudwatch/internal/storage/utils"
+)
+
+const (
+	// MaxValue which CloudWatch accepts, either positive or negative.
+	MaxValue = 1.174271e+108
+	// MinValue which CloudWatch accepts other than zero, either positive or negative.
+	MinValue = 8.515920e-109
+	// MaxValues which CloudWatch accepts in the Values/Counts of a single datum.
+	MaxValues = 150
+	// MaxNameLength which CloudWatch accepts for metric names, dimension names and dimension values.
+	MaxNameLength = 255
+
+	// ActionDrop drops the value, or the datum when the rule applies to the whole datum.
+	ActionDrop = "drop"
+	// ActionClamp replaces a value with the closest value CloudWatch accepts.
+	ActionClamp = "clamp"
+	// ActionTruncate shortens a name or value to the length CloudWatch accepts.
+	ActionTruncate = "truncate"
+	// ActionReplace replaces characters CloudWatch does not accept with an underscore.
+	ActionReplace = "replace"
+	// ActionDropDimensions drops the lowest priority dimensions. Static dimensions and external labels are kept first,
+	// followed by the labels of the series in order.
+	ActionDropDimensions = "drop_dimensions"
+	// ActionSplit splits the values of a datum across several datums.
+	ActionSplit = "split"
+
+	ruleNonFinite         = "non_finite"
+	ruleOutOfRange        = "out_of_range"
+	ruleNameLength        = "name_length"
+	ruleNonASCII          = "non_ascii"
+	ruleTooManyDimensions = "too_many_dimensions"
+	ruleTooManyValues     = "too_many_values"
+)
+
+// Validation of datums against the limits CloudWatch applies, so a single datum cannot get a whole request rejected.
+// Each rule has an action which is taken when a datum breaks it.
+type Validation struct {
+	// +Inf and -Inf values. Either drop (default) or clamp.
+	NonFinite string `json:"non_finite" yaml:"non_finite"`
+	// Values which are too small or too large for CloudWatch. Either drop or clamp (default).
+	OutOfRange string `json:"out_of_range" yaml:"out_of_range"`
+	// Metric names, dimension names and dimension values longer than 255 characters. Either drop or truncate
+	// (default).
+	NameLength string `json:"name_length" yaml:"name_length"`
+	// Metric names, dimension names and dimension values which are not printable ASCII. Either drop or replace
+	// (default).
+	NonASCII string `json:"non_ascii" yaml:"non_ascii"`
+	// Datums with more than 10 dimensions. Either drop or drop_dimensions (default).
+	TooManyDimensions string `json:"too_many_dimensions" yaml:"too_many_dimensions"`
+	// Datums with more than 150 values. Either drop or split (default).
+	TooManyValues string `json:"too_many_values" yaml:"too_many_values"`
+}
+
+// DefaultValidation which keeps as much data as possible.
+var DefaultValidation = Validation{
+	NonFinite:         ActionDrop,
+	OutOfRange:        ActionClamp,
+	NameLength:        ActionTruncate,
+	NonASCII:          ActionReplace,
+	TooManyDimensions: ActionDropDimensions,
+	TooManyValues:     ActionSplit,
+}
+
+// Applies the default action to any rule which has not been set and validates the actions.
+func (v *Validation) defaults() error {
+	for _, rule := range []struct {
+		name     string
+		action   *string
+		fallback string
+		allowed  []string
+	}{
+		{ruleNonFinite, &v.NonFinite, DefaultValidation.NonFinite, []string{ActionDrop, ActionClamp}},
+		{ruleOutOfRange, &v.OutOfRange, DefaultValidation.OutOfRange, []string{ActionDrop, ActionClamp}},
+		{ruleNameLength, &v.NameLength, DefaultValidation.NameLength, []string{ActionDrop, ActionTruncate}},
+		{ruleNonASCII, &v.NonASCII, DefaultValidation.NonASCII, []string{ActionDrop, ActionReplace}},
+		{ruleTooManyDimensions, &v.TooManyDimensions, DefaultValidation.TooManyDimensions, []string{ActionDrop, ActionDropDimensions}},
+		{ruleTooManyValues, &v.TooManyValues, DefaultValidation.TooManyValues, []string{ActionDrop, ActionSplit}},
+	} {
+		if *rule.action == "" {
+			*rule.action = rule.fallback
+		}
+
+		if !storageutils.Contains(rule.allowed, *rule.action) {
+			return fmt.Errorf("validation action not supported for %s: %s", rule.name, *rule.action)
+		}
+	}
+
+	return nil
+}
+
+// Validates a datum, returning the datums which should be pushed in its place. The datum is modified in place and
+// is dropped when nil is returned.
+func (v Validation) validate(datum *cloudwatch.MetricDatum) []*cloudwatch.MetricDatum {
+	if !v.names(datum) {
+		return nil
+	}
+
+	if len(datum.Dimensions) > MaxDimensions {
+		datumsInvalid.WithLabelValues(ruleTooManyDimensions, v.TooManyDimensions).Inc()
+
+		if v.TooManyDimensions == ActionDrop {
+			return nil
+		}
+
+		datum.Dimensions = datum.Dimensions[:MaxDimensions]
+	}
+
+	if datum.StatisticValues != nil {
+		if !v.statistics(datum.StatisticValues) {
+			return nil
+		}
+
+		return []*cloudwatch.MetricDatum{datum}
+	}
+
+	if !v.values(datum) {
+		return nil
+	}
+
+	if len(datum.Values) <= MaxValues {
+		return []*cloudwatch.MetricDatum{datum}
+	}
+
+	datumsInvalid.WithLabelValues(ruleTooManyValues, v.TooManyValues).Inc()
+
+	if v.TooManyValues == ActionDrop {
+		return nil
+	}
+
+	return splitValues(datum, MaxValues)
+}
+
+// Validates the metric name and dimensions, returning false if the datum should be dropped. Dimensions are replaced
+// rather than modified because they can be shared with other datums.
+func (v Validation) names(datum *cloudwatch.MetricDatum) bool {
+	name, ok := v.name(aws.StringValue(datum.MetricName))
+	if !ok {
+		return false
+	}
+
+	datum.MetricName = aws.String(name)
+
+	dimensions := make([]*cloudwatch.Dimension, len(datum.Dimensions))
+
+	for i, dimension := range datum.Dimensions {
+		name, ok := v.name(aws.StringValue(dimension.Name))
+		if !ok {
+			return false
+		}
+
+		value, ok := v.name(aws.StringValue(dimension.Value))
+		if !ok {
+			return false
+		}
+
+		dimensions[i] = &cloudwatch.Dimension{
+			Name:  aws.String(name),
+			Value: aws.String(value),
+		}
+	}
+
+	datum.Dimensions = dimensions
+
+	return true
+}
+
+// Validates a metric name, dimension name or dimension value, returning false if the datum should be dropped.
+func (v Validation) name(name string) (string, bool) {
+	if !printable(name) {
+		datumsInvalid.WithLabelValues(ruleNonASCII, v.NonASCII).Inc()
+
+		if v.NonASCII == ActionDrop {
+			return name, false
+		}
+
+		name = strings.Map(func(r rune) rune {
+			if r < 0x20 || r > 0x7e {
+				return '_'
+			}
+
+			return r
+		}, name)
+	}
+
+	if len(name) > MaxNameLength {
+		datumsInvalid.WithLabelValues(ruleNameLength, v.NameLength).Inc()
+
+		if v.NameLength == ActionDrop {
+			return name, false
+		}
+
+		name = name[:MaxNameLength]
+	}
+
+	return name, true
+}
+
+// Validates the Values of a datum, dropping or clamping any which CloudWatch will not accept. Returns false if no
+// values are left.
+func (v Validation) values(datum *cloudwatch.MetricDatum) bool {
+	var (
+		values []*float64
+		counts []*float64
+	)
+
+	for i, value := range datum.Values {
+		result, ok := v.value(*value)
+		if !ok {
+			continue
+		}
+
+		values = append(values, aws.Float64(result))
+
+		if i < len(datum.Counts) {
+			counts = append(counts, datum.Counts[i])
+		}
+	}
+
+	if len(values) == 0 {
+		return false
+	}
+
+	datum.Values = values
+
+	if len(datum.Counts) > 0 {
+		datum.Counts = counts
+	}
+
+	return true
+}
+
+// Validates each field of a StatisticSet, returning false if the datum should be dropped.
+func (v Validation) statistics(set *cloudwatch.StatisticSet) bool {
+	for _, field := range []*float64{set.Minimum, set.Maximum, set.Sum, set.SampleCount} {
+		if field == nil {
+			continue
+		}
+
+		result, ok := v.value(*field)
+		if !ok {
+			return false
+		}
+
+		*field = result
+	}
+
+	return true
+}
+
+// Validates a single value, returning false if it should be dropped.
+func (v Validation) value(value float64) (float64, bool) {
+	if math.IsInf(value, 0) {
+		datumsInvalid.WithLabelValues(ruleNonFinite, v.NonFinite).Inc()
+
+		if v.NonFinite == ActionDrop {
+			return 0, false
+		}
+
+		return math.Copysign(MaxValue, value), true
+	}
+
+	if math.IsNaN(value) {
+		datumsInvalid.WithLabelValues(ruleNonFinite, ActionDrop).Inc()
+		return 0, false
+	}
+
+	magnitude := math.Abs(value)
+
+	if magnitude > MaxValue || (magnitude > 0 && magnitude < MinValue) {
+		datumsInvalid.WithLabelValues(ruleOutOfRange, v.OutOfRange).Inc()
+
+		if v.OutOfRange == ActionDrop {
+			return 0, false
+		}
+
+		if magnitude > MaxValue {
+			return math.Copysign(MaxValue, value), true
+		}
+
+		return 0, true
+	}
+
+	return value, true
+}
+
+// Splits the values of a datum across several datums which have no more than the given number of values.
+func splitValues(datum *cloudwatch.MetricDatum, size int) []*cloudwatch.MetricDatum {
+	var datums []*cloudwatch.MetricDatum
+
+	for start := 0; start < len(datum.Values); start += size {
+		end := start + size
+		if end > len(datum.Values) {
+			end = len(datum.Values)
+		}
+
+		split := *datum
+		split.Values = datum.Values[start:end]
+
+		if len(datum.Counts) > 0 {
+			split.Counts = datum.Counts[start:end]
+		}
+
+		datums = append(datums, &split)
+	}
+
+	return datums
+}
+
+// Reports whether a string only contains printable ASCII characters.
+func printable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
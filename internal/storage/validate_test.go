@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateValues(t *testing.T) {
+	tests := []struct {
+		name       string
+		validation Validation
+		values     []float64
+		want       []*float64
+	}{
+		{
+			name:       "drop non finite",
+			validation: DefaultValidation,
+			values:     []float64{math.Inf(1), 1, math.Inf(-1)},
+			want:       []*float64{aws.Float64(1)},
+		},
+		{
+			name:       "clamp non finite",
+			validation: Validation{NonFinite: ActionClamp},
+			values:     []float64{math.Inf(1), math.Inf(-1)},
+			want:       []*float64{aws.Float64(MaxValue), aws.Float64(-MaxValue)},
+		},
+		{
+			name:       "clamp out of range",
+			validation: DefaultValidation,
+			values:     []float64{1e200, -1e-200, 0},
+			want:       []*float64{aws.Float64(MaxValue), aws.Float64(0), aws.Float64(0)},
+		},
+		{
+			name:       "drop out of range",
+			validation: Validation{OutOfRange: ActionDrop},
+			values:     []float64{1e200, 2},
+			want:       []*float64{aws.Float64(2)},
+		},
+		{
+			name:       "drop every value",
+			validation: DefaultValidation,
+			values:     []float64{math.Inf(1)},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Nil(t, test.validation.defaults(), test.name)
+
+		datum := &cloudwatch.MetricDatum{MetricName: aws.String("metric1")}
+
+		for _, value := range test.values {
+			datum.Values = append(datum.Values, aws.Float64(value))
+			datum.Counts = append(datum.Counts, aws.Float64(1))
+		}
+
+		datums := test.validation.validate(datum)
+
+		if test.want == nil {
+			assert.Empty(t, datums, test.name)
+			continue
+		}
+
+		assert.Len(t, datums, 1, test.name)
+		assert.Equal(t, test.want, datums[0].Values, test.name)
+		assert.Len(t, datums[0].Counts, len(test.want), test.name)
+	}
+}
+
+func TestValidateStatistics(t *testing.T) {
+	validation := DefaultValidation
+
+	datum := &cloudwatch.MetricDatum{
+		MetricName: aws.String("metric1"),
+		StatisticValues: &cloudwatch.StatisticSet{
+			Minimum:     aws.Float64(1),
+			Maximum:     aws.Float64(math.Inf(1)),
+			Sum:         aws.Float64(math.Inf(1)),
+			SampleCount: aws.Float64(2),
+		},
+	}
+
+	assert.Empty(t, validation.validate(datum))
+
+	validation.NonFinite = ActionClamp
+
+	datum.StatisticValues.Maximum = aws.Float64(math.Inf(1))
+	datum.StatisticValues.Sum = aws.Float64(math.Inf(1))
+
+	datums := validation.validate(datum)
+	assert.Len(t, datums, 1)
+	assert.Equal(t, MaxValue, *datums[0].StatisticValues.Maximum)
+}
+
+func TestValidateNames(t *testing.T) {
+	long := strings.Repeat("a", MaxNameLength+1)
+
+	datum := func() *cloudwatch.MetricDatum {
+		return &cloudwatch.MetricDatum{
+			MetricName: aws.String("metric1"),
+			Dimensions: []*cloudwatch.Dimension{
+				{Name: aws.String("path"), Value: aws.String(long)},
+				{Name: aws.String("city"), Value: aws.String("Zürich")},
+			},
+			Values: []*float64{aws.Float64(1)},
+		}
+	}
+
+	datums := DefaultValidation.validate(datum())
+	assert.Len(t, datums, 1)
+	assert.Equal(t, long[:MaxNameLength], *datums[0].Dimensions[0].Value)
+	assert.Equal(t, "Z_rich", *datums[0].Dimensions[1].Value)
+
+	assert.Empty(t, Validation{NameLength: ActionDrop, NonASCII: ActionReplace}.validate(datum()))
+	assert.Empty(t, Validation{NameLength: ActionTruncate, NonASCII: ActionDrop}.validate(datum()))
+}
+
+func TestValidateLimits(t *testing.T) {
+	datum := func() *cloudwatch.MetricDatum {
+		datum := &cloudwatch.MetricDatum{MetricName: aws.String("metric1")}
+
+		for i := 0; i < MaxDimensions+2; i++ {
+			datum.Dimensions = append(datum.Dimensions, &cloudwatch.Dimension{
+				Name:  aws.String(fmt.Sprintf("dimension%d", i)),
+				Value: aws.String("value"),
+			})
+		}
+
+		for i := 0; i < MaxValues*2+1; i++ {
+			datum.Values = append(datum.Values, aws.Float64(float64(i)))
+			datum.Counts = append(datum.Counts, aws.Float64(1))
+		}
+
+		return datum
+	}
+
+	// The lowest priority dimensions are dropped and the values are split across datums.
+	datums := DefaultValidation.validate(datum())
+	assert.Len(t, datums, 3)
+
+	for i, want := range []int{MaxValues, MaxValues, 1} {
+		assert.Len(t, datums[i].Dimensions, MaxDimensions)
+		assert.Equal(t, "dimension0", *datums[i].Dimensions[0].Name)
+		assert.Len(t, datums[i].Values, want)
+		assert.Len(t, datums[i].Counts, want)
+	}
+
+	assert.Empty(t, Validation{TooManyDimensions: ActionDrop, TooManyValues: ActionSplit}.validate(datum()))
+	assert.Empty(t, Validation{TooManyDimensions: ActionDropDimensions, TooManyValues: ActionDrop}.validate(datum()))
+}
+
+func TestValidationInvalid(t *testing.T) {
+	validation := Validation{NonFinite: ActionTruncate}
+	assert.Error(t, validation.defaults())
+}
@@ -0,0 +1,331 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/skpr/prometheus-cloudwatch/internal/relabel"
+)
+
+const (
+	// TypeHistogram groups the _bucket, _sum and _count series of a histogram into a single distribution.
+	TypeHistogram = "histogram"
+	// TypeSummary pushes the _sum and _count series of a summary as a StatisticSet and each quantile as a metric.
+	TypeSummary = "summary"
+
+	suffixBucket = "_bucket"
+	suffixSum    = "_sum"
+	suffixCount  = "_count"
+)
+
+// Whitelist which governs which metrics are pushed to CloudWatch.
+type Whitelist struct {
+	// Metrics which are pushed. Names can be a glob eg. node_* or a regular expression wrapped in slashes eg. /node_.*/,
+	// followed by label matchers the same as a Prometheus selector eg. node_load1{job="node"}.
+	Metrics []Metric `json:"metrics" yaml:"metrics"`
+	// Labels which are used as dimensions. Supports the same patterns as metric names.
+	Labels []string `json:"labels" yaml:"labels"`
+	// Relabelling applied to every series before it is matched against the whitelist, in the same format as
+	// Prometheus write_relabel_configs.
+	RelabelConfigs []*relabel.Config `json:"relabel_configs" yaml:"relabel_configs"`
+	// Metrics, series and dimensions which are denied even when they have been whitelisted.
+	Deny        Deny   `json:"deny"        yaml:"deny"`
+	Aggregation string `json:"aggregation" yaml:"aggregation"`
+	// Strips the unit suffix eg. _seconds or _bytes_total from every metric name.
+	StripUnitSuffix bool `json:"strip_unit_suffix" yaml:"strip_unit_suffix"`
+	// Publishes metrics which do not have any of the whitelisted labels without dimensions, instead of skipping them.
+	AllowNoDimensions bool `json:"allow_no_dimensions" yaml:"allow_no_dimensions"`
+	// Dimensions which are added to every datum eg. Cluster: production.
+	StaticDimensions map[string]string `json:"static_dimensions" yaml:"static_dimensions"`
+	// Labels which are promoted to a dimension with a different name whenever a series has them, eg. the external
+	// labels of Prometheus. Keyed by label name.
+	ExternalLabels map[string]string `json:"external_labels" yaml:"external_labels"`
+	// Actions taken when a datum breaks a CloudWatch limit.
+	Validation Validation `json:"validation" yaml:"validation"`
+	// Routes which push series to a namespace other than the default, matched in the order they were declared.
+	Namespaces []Route `json:"namespaces" yaml:"namespaces"`
+	// How series which collapse into the same datum once labels are dropped are combined. Defaults to "distribution".
+	Collision string `json:"collision" yaml:"collision"`
+}
+
+// Metric which has been whitelisted and how it is converted before being pushed.
+type Metric struct {
+	Name string `json:"name" yaml:"name"`
+	// Type of metric family when it is made up of multiple series eg. "histogram".
+	Type string `json:"type" yaml:"type"`
+	// Converts a counter to a per-second "rate" or per-sample "delta".
+	Counter string `json:"counter" yaml:"counter"`
+	// Quantiles of a summary which are pushed. All quantiles are pushed when empty.
+	Quantiles []float64 `json:"quantiles" yaml:"quantiles"`
+	// Pushes summary quantiles with a "quantile" dimension instead of as separate metrics eg. name_p99.
+	QuantileDimension bool `json:"quantile_dimension" yaml:"quantile_dimension"`
+	// CloudWatch unit the metric is pushed with. Inferred from the name when empty.
+	Unit string `json:"unit" yaml:"unit"`
+	// Strips the unit suffix eg. _seconds or _bytes_total from the metric name.
+	StripUnitSuffix bool `json:"strip_unit_suffix" yaml:"strip_unit_suffix"`
+	// Storage resolution in seconds. Either 60 (default) or 1 for high resolution.
+	Resolution int64 `json:"resolution" yaml:"resolution"`
+	// Labels which are used as dimensions instead of the global list. Supports the same patterns as the global list.
+	Dimensions []string `json:"dimensions" yaml:"dimensions"`
+	// Publishes with exactly the listed dimensions, dropping series which are missing any of them.
+	StrictDimensions bool `json:"strict_dimensions" yaml:"strict_dimensions"`
+	// Publishes the metric without dimensions when it does not have any of the dimension labels.
+	AllowNoDimensions bool `json:"allow_no_dimensions" yaml:"allow_no_dimensions"`
+	// Publishes the metric aggregated across series at other dimension granularities.
+	Rollups []Rollup `json:"rollups" yaml:"rollups"`
+	// How series which collapse into the same datum once labels are dropped are combined eg. "sum".
+	Collision string `json:"collision" yaml:"collision"`
+
+	// Compiled from the dimensions.
+	dimensions *matcher
+	// Namespace the series which matched is routed to.
+	namespace string
+	// Labels of the series which matched, as they were received before relabelling.
+	labels []prompb.Label
+}
+
+// UnmarshalYAML allows a metric to be declared by name only.
+func (m *Metric) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+
+	if err := unmarshal(&name); err == nil {
+		m.Name = name
+		return nil
+	}
+
+	type plain Metric
+
+	return unmarshal((*plain)(m))
+}
+
+// Validate the configuration for a metric.
+func (m Metric) Validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("metric name was not provided")
+	}
+
+	selector, err := parseSelector(m.Name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := compilePattern(selector.name); err != nil {
+		return err
+	}
+
+	if m.Counter != "" && m.Counter != CounterRate && m.Counter != CounterDelta {
+		return fmt.Errorf("counter conversion not supported for %s: %s", m.Name, m.Counter)
+	}
+
+	if m.Type != "" && m.Type != TypeHistogram && m.Type != TypeSummary {
+		return fmt.Errorf("type not supported for %s: %s", m.Name, m.Type)
+	}
+
+	if m.Unit != "" {
+		if err := validateUnit(m.Unit); err != nil {
+			return fmt.Errorf("%s: %s", m.Name, err)
+		}
+	}
+
+	if m.Resolution != 0 && m.Resolution != 1 && m.Resolution != 60 {
+		return fmt.Errorf("resolution must be 1 or 60 seconds for %s: %d", m.Name, m.Resolution)
+	}
+
+	if m.StrictDimensions && len(m.Dimensions) == 0 {
+		return fmt.Errorf("strict dimensions require dimensions for %s", m.Name)
+	}
+
+	for _, dimension := range m.Dimensions {
+		p, err := compilePattern(dimension)
+		if err != nil {
+			return fmt.Errorf("%s: %s", m.Name, err)
+		}
+
+		if m.StrictDimensions && !p.literal() {
+			return fmt.Errorf("strict dimensions cannot be patterns for %s: %s", m.Name, dimension)
+		}
+	}
+
+	if m.Collision != "" {
+		if err := validateCollision(m.Collision); err != nil {
+			return fmt.Errorf("%s: %s", m.Name, err)
+		}
+	}
+
+	for _, rollup := range m.Rollups {
+		if err := rollup.Validate(); err != nil {
+			return fmt.Errorf("%s: %s", m.Name, err)
+		}
+	}
+
+	if m.Type != "" && len(m.Rollups) > 0 {
+		return fmt.Errorf("rollups cannot be used with type %s: %s", m.Type, m.Name)
+	}
+
+	if m.Type != "" && m.Counter != "" {
+		return fmt.Errorf("counter conversion cannot be used with type %s: %s", m.Type, m.Name)
+	}
+
+	return nil
+}
+
+// Period which samples are grouped by, matching the storage resolution.
+func (m Metric) period() time.Duration {
+	if m.Resolution == 1 {
+		return HighResolution
+	}
+
+	return StandardResolution
+}
+
+// StorageResolution set on datums. Left empty for standard resolution, which is the CloudWatch default.
+func (m Metric) storageResolution() *int64 {
+	if m.Resolution == 1 {
+		return aws.Int64(1)
+	}
+
+	return nil
+}
+
+// Rules compiled from the metrics whitelist. Rules are looked up by name in a map and the rules for names matched by
+// a pattern are cached, so the patterns are only evaluated the first time a name is seen. Label matchers are evaluated
+// for every series.
+type rules struct {
+	metrics   []Metric
+	selectors []selector
+	patterns  []pattern
+	// Rules with a literal name, by name.
+	exact map[string][]int
+	// Rules with a glob, regular expression or empty name, in the order they were declared.
+	wildcard []int
+
+	mutex sync.RWMutex
+	cache map[string][]ruleMatch
+}
+
+// Rule which matches a series name.
+type ruleMatch struct {
+	index  int
+	suffix string
+}
+
+// Compiles the rules for a list of whitelisted metrics.
+func newRules(metrics []Metric) (*rules, error) {
+	r := &rules{
+		metrics: make([]Metric, len(metrics)),
+		exact:   make(map[string][]int),
+		cache:   make(map[string][]ruleMatch),
+	}
+
+	for i, metric := range metrics {
+		if len(metric.Dimensions) > 0 {
+			dimensions, err := newMatcher(metric.Dimensions)
+			if err != nil {
+				return nil, err
+			}
+
+			metric.dimensions = dimensions
+		}
+
+		r.metrics[i] = metric
+
+		s, err := parseSelector(metric.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := compilePattern(s.name)
+		if err != nil {
+			return nil, err
+		}
+
+		r.selectors = append(r.selectors, s)
+		r.patterns = append(r.patterns, p)
+
+		if s.name != "" && p.literal() {
+			r.exact[s.name] = append(r.exact[s.name], i)
+			continue
+		}
+
+		r.wildcard = append(r.wildcard, i)
+	}
+
+	return r, nil
+}
+
+// Returns the whitelisted metric for a series. Series which belong to a metric family are matched by the family
+// name, in which case the suffix of the series is also returned. Rules with a literal name take precedence over
+// patterns.
+func (r *rules) metric(name string, labels []prompb.Label) (Metric, string, bool) {
+	r.mutex.RLock()
+	matches, ok := r.cache[name]
+	r.mutex.RUnlock()
+
+	if !ok {
+		matches = r.lookup(name)
+
+		r.mutex.Lock()
+		if len(r.cache) >= matcherCacheSize {
+			r.cache = make(map[string][]ruleMatch)
+		}
+		r.cache[name] = matches
+		r.mutex.Unlock()
+	}
+
+	for _, match := range matches {
+		if r.selectors[match.index].matchLabels(labels) {
+			return r.metrics[match.index], match.suffix, true
+		}
+	}
+
+	return Metric{}, "", false
+}
+
+// Finds the rules which match a series name, in order of precedence.
+func (r *rules) lookup(name string) []ruleMatch {
+	var matches []ruleMatch
+
+	for _, i := range r.find(name, func(metric Metric) bool {
+		return metric.Type != TypeHistogram
+	}) {
+		matches = append(matches, ruleMatch{index: i})
+	}
+
+	for _, suffix := range []string{suffixBucket, suffixSum, suffixCount} {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+
+		for _, i := range r.find(strings.TrimSuffix(name, suffix), func(metric Metric) bool {
+			return metric.Type == TypeHistogram || (metric.Type != "" && suffix != suffixBucket)
+		}) {
+			matches = append(matches, ruleMatch{index: i, suffix: suffix})
+		}
+	}
+
+	return matches
+}
+
+// Finds the rules which match a name and are accepted.
+func (r *rules) find(name string, accept func(Metric) bool) []int {
+	var found []int
+
+	for _, i := range r.exact[name] {
+		if accept(r.metrics[i]) {
+			found = append(found, i)
+		}
+	}
+
+	for _, i := range r.wildcard {
+		if accept(r.metrics[i]) && (r.selectors[i].name == "" || r.patterns[i].match(name)) {
+			found = append(found, i)
+		}
+	}
+
+	return found
+}
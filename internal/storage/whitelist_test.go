@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestWhitelistUnmarshal(t *testing.T) {
+	config := `
+metrics:
+  - metric1
+  - name: requests_total
+    counter: rate
+labels:
+  - foo
+deny:
+  metrics:
+    - metric2
+  selectors:
+    - '{namespace="kube-system"}'
+  dimensions:
+    - pod
+`
+
+	var whitelist Whitelist
+
+	assert.Nil(t, yaml.Unmarshal([]byte(config), &whitelist))
+
+	want := Whitelist{
+		Metrics: []Metric{
+			{
+				Name: "metric1",
+			},
+			{
+				Name:    "requests_total",
+				Counter: CounterRate,
+			},
+		},
+		Labels: []string{"foo"},
+		Deny: Deny{
+			Metrics:    []string{"metric2"},
+			Selectors:  []string{`{namespace="kube-system"}`},
+			Dimensions: []string{"pod"},
+		},
+	}
+
+	assert.Equal(t, want, whitelist)
+}
+
+func TestMetricValidate(t *testing.T) {
+	assert.Nil(t, Metric{Name: "metric1", Dimensions: []string{"namespace", "kubernetes_*"}}.Validate())
+	assert.Nil(t, Metric{Name: "metric1", Dimensions: []string{"namespace"}, StrictDimensions: true}.Validate())
+	assert.Error(t, Metric{Name: "metric1", StrictDimensions: true}.Validate())
+	assert.Error(t, Metric{Name: "metric1", Dimensions: []string{"kubernetes_*"}, StrictDimensions: true}.Validate())
+	assert.Error(t, Metric{Name: "metric1", Dimensions: []string{"/(/"}}.Validate())
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"errors"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
+	"path/filepath"
+	"strconv"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/gogo/protobuf/proto"
@@ -14,25 +19,102 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/prometheus/prompb"
-	"github.com/rs/xid"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"gopkg.in/yaml.v2"
 
+	"github.com/skpr/prometheus-cloudwatch/internal/deadletter"
+	"github.com/skpr/prometheus-cloudwatch/internal/pipeline"
+	"github.com/skpr/prometheus-cloudwatch/internal/queue"
 	"github.com/skpr/prometheus-cloudwatch/internal/storage"
 )
 
 var (
-	cliAddress   = kingpin.Flag("address", "Address which this writer will respond to requests.").Envar("PROMETHUES_CLOUDWATCH_ADDRESS").Default(":8080").String()
-	cliNamespace = kingpin.Flag("namespace", "CloudWatch naemspace to store metrics.").Envar("PROMETHUES_CLOUDWATCH_NAMESPACE").Default("prometheus").String()
-	cliBatch     = kingpin.Flag("batch", "Number of records to push in a batch.").Envar("PROMETHUES_CLOUDWATCH_BATCH").Default("10").Int()
-	cliWhitelist = kingpin.Flag("whitelist", "Path to whitelist configuration file.").Envar("PROMETHUES_CLOUDWATCH_WHITELIST").Required().String()
-	cliFrequency = kingpin.Flag("frequency", "How frequently to allow a push to CloudWatch.").Envar("PROMETHUES_CLOUDWATCH_FREQUENCY").Default("1m").Duration()
-	cliVerbose   = kingpin.Flag("verbose", "Print addition debug information.").Envar("PROMETHUES_CLOUDWATCH_VERBOSE").Bool()
-	cliExporter  = kingpin.Flag("exporter", "Address which Prometheus exporter metrics can be scraped.").Envar("PROMETHUES_CLOUDWATCH_EXPORTER").Default(":9000").String()
+	cliAddress         = kingpin.Flag("address", "Address which this writer will respond to requests.").Envar("PROMETHUES_CLOUDWATCH_ADDRESS").Default(":8080").String()
+	cliNamespace       = kingpin.Flag("namespace", "CloudWatch naemspace to store metrics.").Envar("PROMETHUES_CLOUDWATCH_NAMESPACE").Default("prometheus").String()
+	cliBatch           = kingpin.Flag("batch", "Maximum number of datums to push in a batch. Batches are also limited by the size of the request.").Envar("PROMETHUES_CLOUDWATCH_BATCH").Default("1000").Int()
+	cliWhitelist       = kingpin.Flag("whitelist", "Path to whitelist configuration file.").Envar("PROMETHUES_CLOUDWATCH_WHITELIST").Required().String()
+	cliFrequency       = kingpin.Flag("frequency", "How frequently to push samples which have been aggregated to CloudWatch.").Envar("PROMETHUES_CLOUDWATCH_FREQUENCY").Default("1m").Duration()
+	cliVerbose         = kingpin.Flag("verbose", "Print addition debug information.").Envar("PROMETHUES_CLOUDWATCH_VERBOSE").Bool()
+	cliRetryAfter      = kingpin.Flag("retry-after", "How long Prometheus is asked to wait before retrying when the writer is saturated or CloudWatch is failing requests. Doubled for each consecutive batch CloudWatch throttles, up to 16 times.").Envar("PROMETHUES_CLOUDWATCH_RETRY_AFTER").Default("10s").Duration()
+	cliQueue           = kingpin.Flag("queue", "Number of write requests which can be queued for processing. Requests are rejected with a 429 once it is full, which Prometheus only retries with retry_on_http_429.").Envar("PROMETHUES_CLOUDWATCH_QUEUE").Default("100").Int()
+	cliWorkers         = kingpin.Flag("workers", "Number of workers pushing batches to CloudWatch concurrently.").Envar("PROMETHUES_CLOUDWATCH_WORKERS").Default("4").Int()
+	cliStoragePath     = kingpin.Flag("storage.path", "Directory where batches are queued on disk until pushed. Batches are queued in memory when not set.").Envar("PROMETHUES_CLOUDWATCH_STORAGE_PATH").String()
+	cliStorageBytes    = kingpin.Flag("storage.max-bytes", "Maximum size of the disk queue before the oldest batches are dropped.").Envar("PROMETHUES_CLOUDWATCH_STORAGE_MAX_BYTES").Default("1GB").Bytes()
+	cliStorageMaxAge   = kingpin.Flag("storage.max-age", "Maximum age of batches in the disk queue before they are dropped.").Envar("PROMETHUES_CLOUDWATCH_STORAGE_MAX_AGE").Default("24h").Duration()
+	cliRetryMax        = kingpin.Flag("retry.max-retries", "Number of times a batch is retried after CloudWatch throttles or fails it.").Envar("PROMETHUES_CLOUDWATCH_RETRY_MAX_RETRIES").Default("5").Int()
+	cliRetryBaseDelay  = kingpin.Flag("retry.base-delay", "Delay before the first retry, which doubles with every retry after it.").Envar("PROMETHUES_CLOUDWATCH_RETRY_BASE_DELAY").Default("500ms").Duration()
+	cliRetryMaxDelay   = kingpin.Flag("retry.max-delay", "Longest delay between retries.").Envar("PROMETHUES_CLOUDWATCH_RETRY_MAX_DELAY").Default("20s").Duration()
+	cliRetryMaxElapsed = kingpin.Flag("retry.max-elapsed", "Longest time spent pushing a batch, including retries.").Envar("PROMETHUES_CLOUDWATCH_RETRY_MAX_ELAPSED").Default("1m").Duration()
+	cliDeadLetterPath  = kingpin.Flag("deadletter.path", "File which datums that could not be pushed to CloudWatch are written to. Datums are dropped when not set.").Envar("PROMETHUES_CLOUDWATCH_DEADLETTER_PATH").String()
+	cliDeadLetterBytes = kingpin.Flag("deadletter.max-bytes", "Size the dead-letter file can grow to before it is rotated.").Envar("PROMETHUES_CLOUDWATCH_DEADLETTER_MAX_BYTES").Default("64MB").Bytes()
+	cliDeadLetterFiles = kingpin.Flag("deadletter.max-files", "Number of rotated dead-letter files which are kept.").Envar("PROMETHUES_CLOUDWATCH_DEADLETTER_MAX_FILES").Default("5").Int()
+	cliExporter        = kingpin.Flag("exporter", "Address which Prometheus exporter metrics can be scraped.").Envar("PROMETHUES_CLOUDWATCH_EXPORTER").Default(":9000").String()
+)
+
+var (
+	cliRun    = kingpin.Command("run", "Receive metrics from Prometheus and push them to CloudWatch.").Default()
+	cliReplay = kingpin.Command("replay-deadletter", "Push the datums in the dead-letter file to CloudWatch again once the configuration or the data has been fixed. The writer should be stopped first.")
 )
 
 func main() {
-	kingpin.Parse()
+	command := kingpin.Parse()
+
+	var whitelist storage.Whitelist
+
+	file, err := ioutil.ReadFile(*cliWhitelist)
+	if err != nil {
+		panic(err)
+	}
+
+	err = yaml.Unmarshal(file, &whitelist)
+	if err != nil {
+		panic(err)
+	}
+
+	client, err := storage.New(log.Base(), *cliNamespace, *cliBatch, whitelist)
+	if err != nil {
+		panic(err)
+	}
+
+	if command == cliReplay.FullCommand() {
+		if err := replay(client); err != nil {
+			panic(err)
+		}
+
+		return
+	}
+
+	deadletters, err := deadLetter()
+	if err != nil {
+		panic(err)
+	}
+
+	sender, err := newSender(deadletters)
+	if err != nil {
+		panic(err)
+	}
+
+	batches, err := batchQueue()
+	if err != nil {
+		panic(err)
+	}
+
+	wal, err := writeAheadLog()
+	if err != nil {
+		panic(err)
+	}
+
+	pipe, err := pipeline.New(log.Base(), client, sender, batches, pipeline.Params{
+		QueueSize:  *cliQueue,
+		Workers:    *cliWorkers,
+		Frequency:  *cliFrequency,
+		RetryAfter: *cliRetryAfter,
+		DeadLetter: deadletters,
+		WAL:        wal,
+	})
+	if err != nil {
+		panic(err)
+	}
 
 	wg := workgroup.Group{}
 
@@ -40,42 +122,107 @@ func main() {
 	wg.Add(metrics)
 
 	// Start writing metrics.
-	wg.Add(writer)
+	wg.Add(func(stop <-chan struct{}) error {
+		return writer(stop, pipe)
+	})
+
+	// Aggregate and push metrics in the background.
+	wg.Add(pipe.Run)
 
 	if err := wg.Run(); err != nil {
 		panic(err)
 	}
 }
 
-// Starts to Prometheus writer.
-func writer(stop <-chan struct{}) error {
-	lock := time.Now()
+// Returns the sender which pushes batches to CloudWatch. A single CloudWatch client is shared by all workers. Retries
+// are handled by the sender, so the retry budget is not multiplied by the retries of the SDK.
+func newSender(deadletters storage.DeadLetter) (*storage.Sender, error) {
+	return storage.NewSender(log.Base(), cloudwatch.New(session.New(), aws.NewConfig().WithMaxRetries(0)), storage.RetryParams{
+		MaxRetries: *cliRetryMax,
+		BaseDelay:  *cliRetryBaseDelay,
+		MaxDelay:   *cliRetryMaxDelay,
+		MaxElapsed: *cliRetryMaxElapsed,
+	}, deadletters)
+}
 
-	mux := http.NewServeMux()
+// Returns the sink which datums that could not be pushed are written to, or nil when they are dropped.
+func deadLetter() (storage.DeadLetter, error) {
+	if *cliDeadLetterPath == "" {
+		return nil, nil
+	}
 
-	var whitelist storage.Whitelist
+	log.Infof("Writing datums which could not be pushed to: %s", *cliDeadLetterPath)
 
-	file, err := ioutil.ReadFile(*cliWhitelist)
+	return deadletter.New(deadLetterParams())
+}
+
+// Params for the dead-letter file.
+func deadLetterParams() deadletter.Params {
+	return deadletter.Params{
+		Path:     *cliDeadLetterPath,
+		MaxBytes: int64(*cliDeadLetterBytes),
+		MaxFiles: *cliDeadLetterFiles,
+	}
+}
+
+// Pushes the datums in the dead-letter files to CloudWatch again. Datums which still could not be pushed replace the
+// files once every datum has been tried.
+func replay(client storage.Interface) error {
+	if *cliDeadLetterPath == "" {
+		return errors.New("dead-letter path was not provided")
+	}
+
+	failed := &deadletter.Memory{}
+
+	sender, err := newSender(failed)
 	if err != nil {
 		return err
 	}
 
-	err = yaml.Unmarshal(file, &whitelist)
+	replayed, left, err := deadletter.Replay(*cliDeadLetterPath, client, sender, failed)
 	if err != nil {
 		return err
 	}
 
-	mux.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
-		logger := log.With("request", xid.New())
+	log.Infof("Replayed datums from the dead-letter file: %d", replayed)
 
-		if time.Now().Before(lock) {
-			if *cliVerbose {
-				log.Infof("Skipping request will store new requests after: %s", lock.String())
-			}
+	if left > 0 {
+		log.Errorf("Datums which still could not be pushed were written to the dead-letter file: %d", left)
+	}
 
-			return
-		}
+	return nil
+}
+
+// Returns the queue which holds batches until they are pushed to CloudWatch.
+func batchQueue() (queue.Interface, error) {
+	if *cliStoragePath == "" {
+		return queue.NewMemory(*cliWorkers), nil
+	}
+
+	log.Infof("Queueing batches on disk: %s", *cliStoragePath)
+
+	return queue.NewDisk(queue.DiskParams{
+		Path:     *cliStoragePath,
+		MaxBytes: int64(*cliStorageBytes),
+		MaxAge:   *cliStorageMaxAge,
+	})
+}
+
+// Returns the write-ahead log which requests are appended to before they are acknowledged, or nil when batches are
+// queued in memory.
+func writeAheadLog() (*queue.WAL, error) {
+	if *cliStoragePath == "" {
+		return nil, nil
+	}
+
+	return queue.NewWAL(filepath.Join(*cliStoragePath, "wal"))
+}
+
+// Starts to Prometheus writer.
+func writer(stop <-chan struct{}, pipe *pipeline.Pipeline) error {
+	mux := http.NewServeMux()
 
+	mux.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
 		compressed, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -95,27 +242,17 @@ func writer(stop <-chan struct{}) error {
 			return
 		}
 
-		lock = time.Now().Add(*cliFrequency)
-
-		svc := cloudwatch.New(session.New())
-
-		client, err := storage.New(logger, svc, *cliNamespace, *cliBatch, whitelist)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		if *cliVerbose {
+			log.Infof("Received series: %d", len(req.Timeseries))
 		}
 
-		for _, ts := range req.Timeseries {
-			err = client.Add(ts)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		if source := r.URL.Query().Get("source"); source != "" {
+			withSource(&req, source)
 		}
 
-		err = client.Flush()
+		err = pipe.Write(req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
 	})
@@ -135,6 +272,39 @@ func writer(stop <-chan struct{}) error {
 	return http.Serve(listen, mux)
 }
 
+// Adds the remote write source to every series so it can be used to route them.
+func withSource(req *prompb.WriteRequest, source string) {
+	for i := range req.Timeseries {
+		req.Timeseries[i].Labels = append(req.Timeseries[i].Labels, prompb.Label{
+			Name:  storage.SourceLabel,
+			Value: source,
+		})
+	}
+}
+
+// Responds with a status which tells Prometheus whether to retry. Prometheus retries 5xx responses (and 429 when
+// configured to) but drops requests which receive any other 4xx response.
+func writeError(w http.ResponseWriter, err error) {
+	if err == pipeline.ErrQueueFull {
+		w.Header().Set("Retry-After", retryAfter(*cliRetryAfter))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	if berr, ok := err.(*pipeline.BackoffError); ok {
+		w.Header().Set("Retry-After", retryAfter(berr.RetryAfter))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// Formats a duration as whole seconds for the Retry-After header.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
 // Exposes Prometheus metrics.
 func metrics(stop <-chan struct{}) error {
 	mux := http.NewServeMux()